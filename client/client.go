@@ -2,46 +2,326 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log/slog"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const (
 	trans = "tcp"
-	bufferSize = 1024 * 1024
+	// unixPrefix marks an IP argument that is really the path of the server's Unix domain socket
+	unixPrefix = "unix:"
+	defaultBufferSize = 1024 * 1024
 	arguments = 3
+	defaultTimeout = 10 * time.Second
+	defaultRetries = 3
+	defaultRetryDelay = time.Second
+	defaultKeepAlive = 30 * time.Second
+	// openAttempts bounds how often a file that is momentarily locked is tried, openRetryDelay apart
+	openAttempts = 3
+	openRetryDelay = 100 * time.Millisecond
+	// stdinFileName stands for the client's standard input in the list of files to send
+	stdinFileName = "-"
 )
 
+// errInterrupted is returned by Run when the client was stopped by SIGINT or SIGTERM
+var errInterrupted = errors.New("interrupted")
+
+// errDeadline is returned by Run when the client was stopped by -deadline
+var errDeadline = errors.New("deadline reached")
+
+// errServerClosed wraps write errors caused by the server closing its end of the connection
+var errServerClosed = errors.New("server closed connection")
+
+// file status markers sent before each file so the server can account for skipped files
+const (
+	filePresent = 0
+	fileSkipped = 1
+)
+
+// every connection starts with protocolMagic followed by a one byte protocol version,
+// which the server answers with handshakeOK or handshakeUnsupported
+const (
+	protocolMagic = "FTSM"
+	protocolVersion = 12
+	handshakeOK = 0
+	handshakeUnsupported = 1
+)
+
+// request markers sent instead of a file count, 0xFFFFFFFF and 0xFFFFFFFE on the wire
+// they are kept as int32 so they fit in int on 32 bit platforms
+const (
+	// statusRequest asks the server for a status snapshot
+	statusRequest int32 = -1
+	// queryRequest asks the server which files it already has, the file count follows the answer
+	queryRequest int32 = -2
+)
+
+// answers the server sends to a query for a single file
+const (
+	queryAbsent = 0
+	queryPresent = 1
+)
+
+// maxStatusLength bounds the status reply so a misbehaving server cannot exhaust memory
+const maxStatusLength = 64 * 1024
+
+// alreadyStored is sent instead of an offset when the server stored the file on an earlier attempt,
+// its acknowledgement follows right away
+const alreadyStored = -1
+
+// fileRejected is sent instead of an offset when the server won't take the file,
+// its acknowledgement follows right away, carrying the reason
+const fileRejected = -2
+
+// maxReasonLength bounds the reason the server sends with ackRejected
+const maxReasonLength = 16 * 1024
+
+// resumeRestart is sent back instead of the offered offset when the server's partial file
+// doesn't match the start of the file, so the server starts it over
+const resumeRestart = 0
+
+// replies to the destination sent after the handshake
+const (
+	destinationOK = 0
+	destinationRefused = 1
+)
+
+// content flags sent before the content of each file
+const (
+	contentCompressed = 1 << 0
+	// contentChunkAck asks the server for chunkReceived after every chunk, the chunk size follows the flags
+	contentChunkAck = 1 << 1
+	// contentSparse sends chunks of zeros as holes, see sendSparse
+	contentSparse = 1 << 2
+)
+
+// chunkReceived is what the server sends after each chunk with -chunk-ack
+const chunkReceived = 0
+
+// maxAckedChunkSize is the largest -buffer the server accepts with -chunk-ack
+const maxAckedChunkSize = 64 * 1024 * 1024
+
+// acknowledgement codes the server sends after each file
+const (
+	ackOK = 0
+	ackChecksumMismatch = 1
+	ackWriteFailed = 2
+	ackExists = 3
+	ackRejected = 4
+)
+
+// SymlinkPolicy decides what happens when a file to send is a symbolic link
+type SymlinkPolicy int
+
+const (
+	// SymlinkFollow sends the content of the file the link points to
+	SymlinkFollow SymlinkPolicy = iota
+	// SymlinkSkip leaves the link out of the transfer
+	SymlinkSkip
+	// SymlinkError reports the link as a file that cannot be sent
+	SymlinkError
+)
+
+func (p SymlinkPolicy) String() string {
+	switch p {
+	case SymlinkSkip:
+		return "skip"
+	case SymlinkError:
+		return "error"
+	}
+	return "follow"
+}
+
+// parseSymlinkPolicy returns the policy named by the provided string
+func parseSymlinkPolicy(name string) (SymlinkPolicy, error) {
+	for _, policy := range []SymlinkPolicy{SymlinkFollow, SymlinkSkip, SymlinkError} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return SymlinkFollow, fmt.Errorf("invalid symlink policy %q, expected follow, skip or error", name)
+}
+
+// SortOrder decides the order files are sent in
+type SortOrder int
+
+const (
+	// SortNone sends files in the order they were given
+	SortNone SortOrder = iota
+	// SortName sends files in lexical order of their paths
+	SortName
+	// SortSize sends the smallest files first
+	SortSize
+	// SortModTime sends the least recently modified files first
+	SortModTime
+)
+
+func (o SortOrder) String() string {
+	switch o {
+	case SortName:
+		return "name"
+	case SortSize:
+		return "size"
+	case SortModTime:
+		return "mtime"
+	}
+	return "none"
+}
+
+// parseSortOrder returns the order named by the provided string
+func parseSortOrder(name string) (SortOrder, error) {
+	for _, order := range []SortOrder{SortNone, SortName, SortSize, SortModTime} {
+		if order.String() == name {
+			return order, nil
+		}
+	}
+	return SortNone, fmt.Errorf("invalid sort order %q, expected name, size, mtime or none", name)
+}
+
 type ClientState int
 
+// FileResult is the outcome of one file, printed by -json
+type FileResult struct {
+	Name   string `json:"name"`
+	Bytes  int64  `json:"bytes"`
+	// Status is sent, failed, skipped or not sent
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ProgressFunc is called after each chunk of a file is sent
+type ProgressFunc func(fileName string, bytesSent, totalBytes int64)
+
 type ClientFSM struct {
 	err error
 	currentState ClientState
 	ip           string
 	port         string
+	network      string
+	address      string
+	timeout      time.Duration
+	keepAlive    time.Duration
+	retries      int
+	retryDelay   time.Duration
+	attempt      int
+	useTLS       bool
+	insecure     bool
+	compress     bool
+	// chunkAck waits for the server to acknowledge each chunk before sending the next one
+	chunkAck     bool
+	// sparse sends chunks holding nothing but zeros as holes, for disk images and other sparse files
+	sparse       bool
+	rate         int64
+	maxTotal     int64
+	bufferSize   int
+	parallel     int
+	keepPaths    bool
+	limiter      *rateLimiter
+	dryRun       bool
+	// manifestOnly prints the name, size and checksum of every file as JSON lines instead of sending anything
+	manifestOnly bool
+	symlinks     SymlinkPolicy
+	sortOrder    SortOrder
+	status       bool
+	skipUnchanged bool
+	skipEmpty    bool
+	// newerThan, when set, leaves out files last modified at or before it
+	newerThan    time.Time
+	unchanged    []bool
+	verify       bool
+	sendOwner    bool
+	// resumeByContent keys the resume of each file by its checksum, so it survives renaming the file
+	resumeByContent bool
+	verifying    bool
+	// stored marks the files the server acknowledged storing, which -verify checks afterwards
+	stored       []bool
+	showProgress bool
+	progress     ProgressFunc
+	// ctx is cancelled by SIGINT or SIGTERM, which closes the connection and stops the client
+	ctx          context.Context
+	cancel       context.CancelFunc
+	sigChan      chan os.Signal
+	stopClosing  func() bool
+	// started is when Run was first called, for the throughput in the summary and -deadline
+	started      time.Time
+	runDeadline  time.Duration
+	tlsConfig    *tls.Config
+	stdinName    string
+	// storeAs replaces the name the only file is stored under
+	storeAs      string
+	// destination is the subdirectory of the server's storage directory files are stored in
+	destination  string
+	stdinSpool   string
 	fileNames    []string
+	storedNames  []string
+	// fileKeys identify each file within this run, so the server doesn't store a file twice
+	// when it is resent because the acknowledgement of the first attempt was lost
+	fileKeys     []string
 	currentFile  int
+	fileSize     int64
+	offset       int64
+	filesSent    int
+	filesSkipped int
+	filesFailed  int
+	lastSent     int64
+	bytesSent    int64
 	con          net.Conn
+	reader       *bufio.Reader
 	writer 		 *bufio.Writer
 	file 		 *os.File
+	logger       *slog.Logger
+	logLevel     *slog.LevelVar
+	quiet        bool
+	verbose      bool
+	// jsonOutput prints results as JSON to stdout once the client is done, instead of logging progress
+	jsonOutput   bool
+	results      []FileResult
 }
 
 
 const (
 	Initialization ClientState = iota
 	ValidateArgs
+	CheckTotalSize
+	DryRun
+	ManifestOnly
 	ParseIP
+	ParallelUpload
 	ConnetServer
+	SendHandshake
 	SendFileCount
+	QueryStatus
+	QueryFiles
+	VerifyUpload
 	OpenFile
 	SendFileName
+	ReceiveOffset
 	ReadAndSendFileData
+	ReceiveAck
 	SendNextFile
+	Reconnect
 	HandleFatalError
 	HandleError
 	Terminate
@@ -49,146 +329,1164 @@ const (
 )
 
 
-func NewClientFSM() *ClientFSM {
+// NewClientFSM returns a client reading its settings from os.Args
+// a nil logger logs text to stderr at the level chosen by -quiet or -verbose
+func NewClientFSM(tlsConfig *tls.Config, logger *slog.Logger) *ClientFSM {
+	logLevel := new(slog.LevelVar)
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &ClientFSM {
+		ctx: ctx,
+		cancel: cancel,
+		sigChan: make(chan os.Signal, 1),
+		logger: logger,
+		logLevel: logLevel,
 		currentState: ValidateArgs,
+		tlsConfig: tlsConfig,
+		timeout: defaultTimeout,
+		keepAlive: defaultKeepAlive,
+		retries: defaultRetries,
+		retryDelay: defaultRetryDelay,
+		bufferSize: defaultBufferSize,
+		parallel: 1,
+		progress: func(string, int64, int64) {},
 	}
 }
 
 
 func (fsm *ClientFSM) ValidateArgsState() ClientState {
-	args := os.Args[1:]
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flags.DurationVar(&fsm.timeout, "timeout", fsm.timeout, "timeout for connecting to the server and completing the handshake, 0 for none")
+	flags.DurationVar(&fsm.keepAlive, "keepalive", fsm.keepAlive, "TCP keep-alive period, negative to disable")
+	flags.IntVar(&fsm.retries, "retries", fsm.retries, "times to reconnect and retry a file after a network failure")
+	flags.DurationVar(&fsm.retryDelay, "retry-delay", fsm.retryDelay, "delay before the first retry, doubled for every further retry")
+	flags.BoolVar(&fsm.useTLS, "tls", fsm.useTLS, "connect to the server using TLS")
+	flags.BoolVar(&fsm.insecure, "insecure", fsm.insecure, "skip TLS certificate verification, for self-signed certificates")
+	flags.BoolVar(&fsm.compress, "compress", fsm.compress, "gzip file contents before sending them")
+	flags.BoolVar(&fsm.sparse, "sparse", fsm.sparse, "send chunks of zeros as holes the server skips over, for disk images and other sparse files")
+	flags.BoolVar(&fsm.chunkAck, "chunk-ack", fsm.chunkAck, "wait for the server to acknowledge every chunk before sending the next, slower but gentler on lossy links")
+	flags.Int64Var(&fsm.rate, "rate", fsm.rate, "maximum upload rate in bytes per second, 0 for no limit")
+	flags.Int64Var(&fsm.maxTotal, "max-total", fsm.maxTotal, "refuse to send anything if the files add up to more than this many bytes, 0 for no limit")
+	flags.IntVar(&fsm.parallel, "parallel", fsm.parallel, "number of connections to send files over at the same time")
+	flags.IntVar(&fsm.bufferSize, "buffer", fsm.bufferSize, "size in bytes of the chunks files are sent in")
+	flags.BoolVar(&fsm.keepPaths, "relative", fsm.keepPaths, "store files under the relative path given, such as sub/a.txt, instead of their base name")
+	flags.Func("newer-than", "only send files modified after this time, given in RFC 3339 such as 2024-05-01T00:00:00Z or as a duration ago such as 24h", func(value string) error {
+		cutoff, err := parseCutoff(value, time.Now())
+		fsm.newerThan = cutoff
+		return err
+	})
+	flags.BoolVar(&fsm.skipEmpty, "skip-empty", fsm.skipEmpty, "leave out files that are empty")
+	flags.BoolVar(&fsm.skipUnchanged, "skip-unchanged", fsm.skipUnchanged, "ask the server which files it already has and skip those with the same size and checksum")
+	flags.BoolVar(&fsm.sendOwner, "owner", fsm.sendOwner, "send each file's user and group IDs, which a server running as root with -preserve-owner applies")
+	flags.BoolVar(&fsm.resumeByContent, "resume-by-content", fsm.resumeByContent, "resume files by their checksum instead of their name, so a file renamed between attempts still resumes")
+	flags.DurationVar(&fsm.runDeadline, "deadline", fsm.runDeadline, "stop the whole run after this long, reporting what was sent, 0 for no limit")
+	flags.BoolVar(&fsm.verify, "verify", fsm.verify, "once every file is sent, ask the server for the checksums of the stored files and compare them")
+	flags.BoolVar(&fsm.status, "status", fsm.status, "print the server's status as JSON instead of sending files")
+	flags.StringVar(&fsm.destination, "dest", fsm.destination, "subdirectory of the server's storage directory to store the files in")
+	flags.StringVar(&fsm.storeAs, "as", fsm.storeAs, "name to store the file under instead of its own, only with a single file")
+	flags.StringVar(&fsm.stdinName, "name", fsm.stdinName, "name to store the data read from standard input under, required when a file is -")
+	flags.Func("sort", "order to send files in: name, size, mtime or none for the order given (default none)", func(value string) error {
+		order, err := parseSortOrder(value)
+		fsm.sortOrder = order
+		return err
+	})
+	flags.Func("symlinks", "what to do with files that are symbolic links: follow, skip or error (default follow)", func(value string) error {
+		policy, err := parseSymlinkPolicy(value)
+		fsm.symlinks = policy
+		return err
+	})
+	flags.BoolVar(&fsm.manifestOnly, "manifest-only", fsm.manifestOnly, "print a JSON line with the name, size and checksum of every file, without connecting to the server")
+	flags.BoolVar(&fsm.dryRun, "dry-run", fsm.dryRun, "check that every file can be read, without connecting to the server")
+	flags.BoolVar(&fsm.quiet, "quiet", fsm.quiet, "only log errors")
+	flags.BoolVar(&fsm.verbose, "verbose", fsm.verbose, "log every chunk sent")
+	flags.BoolVar(&fsm.jsonOutput, "json", fsm.jsonOutput, "print a JSON array with the result of every file to stdout, logging only errors")
+	flags.BoolVar(&fsm.showProgress, "progress", fsm.showProgress, "print transfer progress to stderr")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		fsm.err = err
+		return HandleFatalError
+	}
+	if fsm.showProgress {
+		fsm.progress = printProgress
+	}
+	if fsm.parallel < 1 {
+		fsm.err = errors.New("-parallel must be at least 1")
+		return HandleFatalError
+	}
+	if fsm.bufferSize < 1 {
+		fsm.err = errors.New("-buffer must be at least 1 byte")
+		return HandleFatalError
+	}
+	if fsm.chunkAck && fsm.compress {
+		fsm.err = errors.New("-chunk-ack and -compress can't be used together")
+		return HandleFatalError
+	}
+	if fsm.sparse && (fsm.compress || fsm.chunkAck) {
+		fsm.err = errors.New("-sparse can't be used with -compress or -chunk-ack")
+		return HandleFatalError
+	}
+	if fsm.chunkAck && fsm.bufferSize > maxAckedChunkSize {
+		fsm.err = fmt.Errorf("-buffer must be at most %d bytes with -chunk-ack", maxAckedChunkSize)
+		return HandleFatalError
+	}
+	if fsm.quiet && fsm.verbose {
+		fsm.err = errors.New("-quiet and -verbose can't be used together")
+		return HandleFatalError
+	}
+	if fsm.quiet || (fsm.jsonOutput && !fsm.verbose) {
+		fsm.logLevel.Set(slog.LevelError)
+	} else if fsm.verbose {
+		fsm.logLevel.Set(slog.LevelDebug)
+	}
+	if fsm.runDeadline < 0 {
+		fsm.err = errors.New("-deadline must not be negative")
+		return HandleFatalError
+	}
+	if fsm.runDeadline > 0 {
+		ctx, cancel := context.WithDeadline(fsm.ctx, fsm.started.Add(fsm.runDeadline))
+		cancelParent := fsm.cancel
+		fsm.ctx, fsm.cancel = ctx, func() {
+			cancel()
+			cancelParent()
+		}
+	}
+	signal.Notify(fsm.sigChan, os.Interrupt, syscall.SIGTERM)
+	go fsm.handleSignal()
+
+	fsm.limiter = newRateLimiter(fsm.rate)
+	if fsm.useTLS && fsm.tlsConfig == nil {
+		fsm.tlsConfig = &tls.Config{InsecureSkipVerify: fsm.insecure}
+	}
+
+	args := flags.Args()
+	if fsm.status && len(args) == arguments - 1 {
+		fsm.ip = args[0]
+		fsm.port = args[1]
+		return ParseIP
+	}
 	if len(args) < arguments {
-		fsm.err = errors.New("invalid number of arguments, <ip> <port> <filename1>...<filenameN>")
+		fsm.err = errors.New("invalid number of arguments, [options] <ip> <port> <filename1>...<filenameN>")
 		return HandleFatalError
 	}
 	fsm.ip = args[0]
 	fsm.port = args[1]
-	fsm.fileNames = args[2:]
+	paths, err := expandFileLists(args[2:])
+	if err != nil {
+		fsm.err = fmt.Errorf("read file list: %w", err)
+		return HandleFatalError
+	}
+	paths, err = expandGlobs(paths)
+	if err != nil {
+		fsm.err = fmt.Errorf("expand patterns: %w", err)
+		return HandleFatalError
+	}
+	fsm.fileNames, fsm.storedNames, err = expandPaths(paths, fsm.keepPaths)
+	if err != nil {
+		fsm.err = fmt.Errorf("expand paths: %w", err)
+		return HandleFatalError
+	}
+	if !fsm.newerThan.IsZero() {
+		total := len(fsm.fileNames)
+		fsm.fileNames, fsm.storedNames = filterNewer(fsm.fileNames, fsm.storedNames, fsm.newerThan)
+		fsm.logger.Info("files modified since cutoff", "files", len(fsm.fileNames), "older", total - len(fsm.fileNames), "cutoff", fsm.newerThan)
+		if len(fsm.fileNames) == 0 {
+			return Terminate
+		}
+	}
+	sortFiles(fsm.fileNames, fsm.storedNames, fsm.sortOrder)
+	fromStdin := 0
+	for i, fileName := range fsm.fileNames {
+		if fileName == stdinFileName {
+			fsm.storedNames[i] = fsm.stdinName
+			fromStdin++
+		}
+	}
+	if fromStdin > 1 {
+		fsm.err = errors.New("standard input can only be sent once")
+		return HandleFatalError
+	}
+	if fsm.storeAs != "" {
+		if len(fsm.fileNames) != 1 {
+			fsm.err = fmt.Errorf("-as can only be used with a single file, got %d", len(fsm.fileNames))
+			return HandleFatalError
+		}
+		fsm.storedNames[0] = fsm.storeAs
+	}
+	if fromStdin == 1 && fsm.stdinName == "" && fsm.storeAs == "" {
+		fsm.err = errors.New("sending standard input requires -name or -as")
+		return HandleFatalError
+	}
+	fsm.fileKeys, err = idempotencyKeys(len(fsm.fileNames))
+	if err != nil {
+		fsm.err = fmt.Errorf("generate idempotency keys: %w", err)
+		return HandleFatalError
+	}
+	if fsm.maxTotal > 0 {
+		return CheckTotalSize
+	}
+	if fsm.dryRun {
+		return DryRun
+	}
+	if fsm.manifestOnly {
+		return ManifestOnly
+	}
 	return ParseIP
 }
 
+// CheckTotalSizeState adds up the size of every file before connecting,
+// failing if any of them is missing or the total is above the -max-total limit
+func (fsm *ClientFSM) CheckTotalSizeState() ClientState {
+	var total int64
+	for _, fileName := range fsm.fileNames {
+		file, err := fsm.openFile(fileName)
+		if err != nil {
+			fsm.err = fmt.Errorf("check size of %q: %w", fileName, err)
+			return HandleFatalError
+		}
+		info, err := file.Stat()
+		file.Close()
+		if err != nil {
+			fsm.err = fmt.Errorf("check size of %q: %w", fileName, err)
+			return HandleFatalError
+		}
+		total += info.Size()
+	}
+	if total > fsm.maxTotal {
+		fsm.err = fmt.Errorf("files add up to %s, more than the limit of %s", formatSize(total), formatSize(fsm.maxTotal))
+		return HandleFatalError
+	}
+	fsm.logger.Info("total size checked", "files", len(fsm.fileNames), "bytes", total)
+	if fsm.dryRun {
+		return DryRun
+	}
+	if fsm.manifestOnly {
+		return ManifestOnly
+	}
+	return ParseIP
+}
+
+// ManifestEntry describes a file that would be sent, in the format of the server's manifest
+type ManifestEntry struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"crc32"`
+}
+
+// ManifestOnlyState prints a manifest entry for every file, under the name the server would store it as,
+// so it can be kept as a record or compared with the server's manifest
+func (fsm *ClientFSM) ManifestOnlyState() ClientState {
+	problems := 0
+	for i, fileName := range fsm.fileNames {
+		skip, err := fsm.checkSymlink(fileName)
+		if skip {
+			fsm.logger.Info("symlink would be skipped", "name", fileName)
+			continue
+		}
+		var entry ManifestEntry
+		var file *os.File
+		if err == nil {
+			file, err = fsm.openFile(fileName)
+		}
+		if err == nil {
+			var info os.FileInfo
+			info, err = file.Stat()
+			if err == nil {
+				entry = ManifestEntry{Name: fsm.storedNames[i], Size: info.Size()}
+				entry.Checksum, err = contentKey(file)
+			}
+			file.Close()
+		}
+		var line []byte
+		if err == nil {
+			line, err = json.Marshal(entry)
+		}
+		if err != nil {
+			fsm.logger.Error("file cannot be sent", "name", fileName, "err", err)
+			problems++
+			continue
+		}
+		fmt.Println(string(line))
+	}
+	if problems > 0 {
+		fsm.err = fmt.Errorf("%d of %d files cannot be sent", problems, len(fsm.fileNames))
+		return HandleFatalError
+	}
+	return Terminate
+}
+
+// DryRunState opens every file the same way a transfer would and reports the ones that can't be sent
+func (fsm *ClientFSM) DryRunState() ClientState {
+	problems := 0
+	for _, fileName := range fsm.fileNames {
+		skip, err := fsm.checkSymlink(fileName)
+		if skip {
+			fsm.logger.Info("symlink would be skipped", "name", fileName)
+			continue
+		}
+		var file *os.File
+		if err == nil {
+			file, err = fsm.openFile(fileName)
+		}
+		if err == nil {
+			_, err = file.Stat()
+			file.Close()
+		}
+		if err != nil {
+			fsm.logger.Error("file cannot be sent", "name", fileName, "err", err)
+			problems++
+			continue
+		}
+		fsm.logger.Info("file ok", "name", fileName)
+	}
+	if problems > 0 {
+		fsm.err = fmt.Errorf("%d of %d files cannot be sent", problems, len(fsm.fileNames))
+		return HandleFatalError
+	}
+	return Terminate
+}
+
 func (fsm *ClientFSM) ParseIPState() ClientState {
-	if strings.Contains(fsm.ip, ":") {
-		fsm.ip = "[" + fsm.ip + "]"
+	// accept IPv6 literals written with brackets, net.JoinHostPort adds them back
+	fsm.ip = strings.TrimSuffix(strings.TrimPrefix(fsm.ip, "["), "]")
+	fsm.network, fsm.address = trans, net.JoinHostPort(fsm.ip, fsm.port)
+	if path, ok := strings.CutPrefix(fsm.ip, unixPrefix); ok {
+		// the port is ignored for a Unix socket
+		fsm.network, fsm.address = "unix", path
+	}
+	if fsm.parallel > 1 && !fsm.status && len(fsm.fileNames) > 1 {
+		return ParallelUpload
 	}
 	return ConnetServer
 }
 
-func (fsm *ClientFSM) ConnetServerState() ClientState {
-	fsm.con, fsm.err = net.Dial(trans, fsm.ip + ":" + fsm.port)
+// ParallelUploadState splits the files between -parallel clients, each sending its share
+// over its own connection, and waits for all of them to finish
+func (fsm *ClientFSM) ParallelUploadState() ClientState {
+	workers := min(fsm.parallel, len(fsm.fileNames))
+	clients := make([]*ClientFSM, workers)
+	for i := range clients {
+		worker := *fsm
+		// each connection can finish on its own, only the parent's context is cancelled by signals
+		worker.ctx, worker.cancel = context.WithCancel(fsm.ctx)
+		worker.sigChan = nil
+		worker.parallel = 1
+		worker.currentState = ConnetServer
+		worker.logger = fsm.logger.With("connection", i + 1)
+		// the rate limit applies to the whole upload, so every connection takes from the same bucket
+		worker.limiter = fsm.limiter
+		worker.fileNames = nil
+		worker.storedNames = nil
+		worker.fileKeys = nil
+		// the results of every connection are printed together once all of them are done
+		worker.jsonOutput = false
+		clients[i] = &worker
+	}
+	for i := range fsm.fileNames {
+		worker := clients[i % workers]
+		worker.fileNames = append(worker.fileNames, fsm.fileNames[i])
+		worker.storedNames = append(worker.storedNames, fsm.storedNames[i])
+		worker.fileKeys = append(worker.fileKeys, fsm.fileKeys[i])
+	}
+
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i, worker := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = worker.Run()
+		}()
+	}
+	wg.Wait()
+
+	fsm.initResults()
+	for w, worker := range clients {
+		// files were dealt out to the connections in turn
+		for j, result := range worker.results {
+			fsm.results[j * workers + w] = result
+		}
+		fsm.filesSent += worker.filesSent
+		fsm.filesSkipped += worker.filesSkipped
+		fsm.filesFailed += worker.filesFailed
+		fsm.bytesSent += worker.bytesSent
+	}
+	elapsed := time.Since(fsm.started)
+	fsm.logger.Info(fmt.Sprintf("Transferred %d/%d files over %d connections, %s in %s (%s)", fsm.filesSent, len(fsm.fileNames), workers,
+		formatSize(fsm.bytesSent), elapsed.Round(time.Millisecond), formatRate(fsm.bytesSent, elapsed)),
+		"sent", fsm.filesSent, "skipped", fsm.filesSkipped, "failed", fsm.filesFailed, "bytes", fsm.bytesSent)
+	fsm.err = errors.Join(errs...)
 	if fsm.err != nil {
 		return HandleFatalError
 	}
+	return Terminate
+}
+
+func (fsm *ClientFSM) ConnetServerState() ClientState {
+	var err error
+	if fsm.tlsConfig != nil {
+		dialer := &net.Dialer{Timeout: fsm.timeout}
+		fsm.con, err = tls.DialWithDialer(dialer, fsm.network, fsm.address, fsm.tlsConfig)
+	} else {
+		fsm.con, err = net.DialTimeout(fsm.network, fsm.address, fsm.timeout)
+	}
+	if err != nil {
+		fsm.err = fmt.Errorf("connect to %s: %w", fsm.address, err)
+		if fsm.attempt > 0 {
+			return Reconnect
+		}
+		return HandleFatalError
+	}
+	if err := tuneConnection(fsm.con, fsm.keepAlive); err != nil {
+		fsm.logger.Warn("could not tune connection", "err", err)
+	}
+	if fsm.stopClosing != nil {
+		fsm.stopClosing()
+	}
+	// closing the connection wakes up any read or write blocked on it
+	con := fsm.con
+	fsm.stopClosing = context.AfterFunc(fsm.ctx, func() {
+		con.Close()
+	})
+	fsm.reader = bufio.NewReader(fsm.con)
 	fsm.writer = bufio.NewWriter(fsm.con)
+	return SendHandshake
+}
+
+// SendHandshakeState tells the server which protocol version the client speaks
+// and fails if the server doesn't support it
+// -timeout bounds the whole handshake too, so a server that accepts but never answers isn't waited on forever
+func (fsm *ClientFSM) SendHandshakeState() ClientState {
+	if fsm.timeout > 0 {
+		fsm.con.SetDeadline(time.Now().Add(fsm.timeout))
+	}
+	_, err := fsm.writer.WriteString(protocolMagic)
+	if err == nil {
+		err = fsm.writer.WriteByte(protocolVersion)
+	}
+	if err == nil {
+		err = fsm.writer.Flush()
+	}
+	if err != nil {
+		fsm.err = fmt.Errorf("send handshake: %w", err)
+		return Reconnect
+	}
+	reply, err := fsm.reader.ReadByte()
+	if err != nil {
+		fsm.err = fmt.Errorf("read handshake reply: %w", err)
+		return Reconnect
+	}
+	if reply != handshakeOK {
+		fsm.err = fmt.Errorf("server does not support protocol version %d", protocolVersion)
+		return HandleFatalError
+	}
+	_, err = sendBytes(fsm.writer, []byte(fsm.destination), fsm.bufferSize)
+	if err != nil {
+		fsm.err = fmt.Errorf("send destination: %w", err)
+		return Reconnect
+	}
+	reply, err = fsm.reader.ReadByte()
+	if err != nil {
+		fsm.err = fmt.Errorf("read destination reply: %w", err)
+		return Reconnect
+	}
+	if reply != destinationOK {
+		fsm.err = fmt.Errorf("server refused destination %q", fsm.destination)
+		return HandleFatalError
+	}
+	fsm.con.SetDeadline(time.Time{})
+	if fsm.status {
+		return QueryStatus
+	}
+	if fsm.verifying {
+		return VerifyUpload
+	}
+	if fsm.skipUnchanged && fsm.unchanged == nil {
+		return QueryFiles
+	}
+	return SendFileCount
+}
+
+// QueryFilesState asks the server about every file before sending any,
+// and marks those it already has with the same size and checksum as unchanged
+func (fsm *ClientFSM) QueryFilesState() ClientState {
+	err := sendInt(fsm.writer, int(queryRequest))
+	if err == nil {
+		err = sendInt(fsm.writer, len(fsm.storedNames))
+	}
+	for i := 0; i < len(fsm.storedNames) && err == nil; i++ {
+		_, err = sendBytes(fsm.writer, []byte(fsm.storedNames[i]), fsm.bufferSize)
+	}
+	if err != nil {
+		fsm.err = fmt.Errorf("send query: %w", err)
+		return Reconnect
+	}
+
+	unchanged := make([]bool, len(fsm.fileNames))
+	for i, fileName := range fsm.fileNames {
+		present, err := fsm.reader.ReadByte()
+		if err != nil {
+			fsm.err = fmt.Errorf("read query answer for %q: %w", fileName, err)
+			return Reconnect
+		}
+		if present != queryPresent {
+			continue
+		}
+		size, err := receiveInt64(fsm.reader)
+		if err != nil {
+			fsm.err = fmt.Errorf("read query answer for %q: %w", fileName, err)
+			return Reconnect
+		}
+		checksum, err := receiveInt(fsm.reader)
+		if err != nil {
+			fsm.err = fmt.Errorf("read query answer for %q: %w", fileName, err)
+			return Reconnect
+		}
+		file, err := fsm.openFile(fileName)
+		if err == nil {
+			unchanged[i] = fileMatches(file, size, uint32(checksum))
+			file.Close()
+		}
+	}
+	fsm.unchanged = unchanged
 	return SendFileCount
 }
 
+// VerifyUploadState asks the server for the size and checksum of every file it acknowledged
+// and compares them with the local files, failing if any stored file is missing or differs
+func (fsm *ClientFSM) VerifyUploadState() ClientState {
+	var sent []int
+	for i, stored := range fsm.stored {
+		if stored {
+			sent = append(sent, i)
+		}
+	}
+	err := sendInt(fsm.writer, int(queryRequest))
+	if err == nil {
+		err = sendInt(fsm.writer, len(sent))
+	}
+	for i := 0; i < len(sent) && err == nil; i++ {
+		_, err = sendBytes(fsm.writer, []byte(fsm.storedNames[sent[i]]), fsm.bufferSize)
+	}
+	if err != nil {
+		fsm.err = fmt.Errorf("send verification query: %w", err)
+		return Reconnect
+	}
+
+	failed := 0
+	for _, i := range sent {
+		fileName := fsm.fileNames[i]
+		present, err := fsm.reader.ReadByte()
+		if err != nil {
+			fsm.err = fmt.Errorf("read verification answer for %q: %w", fileName, err)
+			return Reconnect
+		}
+		if present != queryPresent {
+			fsm.logger.Error("file missing on server", "name", fileName)
+			failed++
+			continue
+		}
+		size, err := receiveInt64(fsm.reader)
+		if err != nil {
+			fsm.err = fmt.Errorf("read verification answer for %q: %w", fileName, err)
+			return Reconnect
+		}
+		checksum, err := receiveInt(fsm.reader)
+		if err != nil {
+			fsm.err = fmt.Errorf("read verification answer for %q: %w", fileName, err)
+			return Reconnect
+		}
+		file, err := fsm.openFile(fileName)
+		if err != nil {
+			fsm.logger.Error("could not reopen file to verify it", "name", fileName, "err", err)
+			failed++
+			continue
+		}
+		if !fileMatches(file, size, uint32(checksum)) {
+			fsm.logger.Error("stored file differs from the file sent", "name", fileName)
+			failed++
+		}
+		file.Close()
+	}
+	// an empty batch ends the connection cleanly
+	err = sendInt(fsm.writer, 0)
+	if err != nil {
+		fsm.logger.Warn("could not end verification connection", "err", err)
+	}
+
+	fsm.logger.Info(fmt.Sprintf("Verified %d/%d files", len(sent) - failed, len(sent)), "failed", failed)
+	if failed > 0 {
+		fsm.err = fmt.Errorf("%d of %d files failed verification", failed, len(sent))
+		return HandleFatalError
+	}
+	return Terminate
+}
+
+// QueryStatusState asks the server for its status and prints the JSON reply to stdout
+func (fsm *ClientFSM) QueryStatusState() ClientState {
+	err := sendInt(fsm.writer, int(statusRequest))
+	if err != nil {
+		fsm.err = fmt.Errorf("send status request: %w", err)
+		return HandleFatalError
+	}
+	status, err := receiveBytes(fsm.reader, maxStatusLength)
+	if err != nil {
+		fsm.err = fmt.Errorf("read status: %w", err)
+		return HandleFatalError
+	}
+	fmt.Println(string(status))
+	return Terminate
+}
+
 func (fsm *ClientFSM) SendFileCountState() ClientState {
-	err := sendInt(fsm.writer, len(fsm.fileNames))
+	// after a reconnect only the files not yet acknowledged are announced
+	err := sendInt(fsm.writer, len(fsm.fileNames) - fsm.currentFile)
 	if err != nil {
-		fsm.err = err
+		fsm.err = fmt.Errorf("send file count: %w", err)
 		return HandleFatalError
 	}
-	fsm.currentFile = 0
 	return OpenFile
 }
 
 func (fsm *ClientFSM) OpenFileState() ClientState {
-	fsm.file, fsm.err = os.Open(fsm.fileNames[fsm.currentFile])
-	if fsm.err != nil {
+	fileName := fsm.fileNames[fsm.currentFile]
+	skip, err := fsm.checkSymlink(fileName)
+	if err != nil {
+		fsm.err = fmt.Errorf("check %q: %w", fileName, err)
 		return HandleError
 	}
+	if skip {
+		fsm.logger.Info("skipping symlink", "name", fileName)
+		return fsm.skipFile(nil)
+	}
+	if fsm.unchanged != nil && fsm.unchanged[fsm.currentFile] {
+		fsm.logger.Info("file unchanged on server, skipping", "name", fileName)
+		return fsm.skipFile(nil)
+	}
+	fsm.file, err = fsm.openFile(fileName)
+	if err != nil {
+		fsm.err = fmt.Errorf("open file %q: %w", fileName, err)
+		return HandleError
+	}
+	if fsm.skipEmpty {
+		if info, err := fsm.file.Stat(); err == nil && info.Mode().IsRegular() && info.Size() == 0 {
+			fsm.file.Close()
+			fsm.logger.Info("skipping empty file", "name", fileName)
+			return fsm.skipFile(nil)
+		}
+	}
 	return SendFileName
 }
 
+// openFile opens the provided file for sending
+// standard input is copied to a temporary file the first time, since its size has to be sent upfront
+// and it can't be read again when a transfer is retried
+func (fsm *ClientFSM) openFile(fileName string) (*os.File, error) {
+	if fileName != stdinFileName {
+		return openWithRetry(os.Open, fileName, openAttempts, openRetryDelay)
+	}
+	if fsm.stdinSpool == "" {
+		spool, err := os.CreateTemp("", "client-stdin-*")
+		if err != nil {
+			return nil, err
+		}
+		fsm.stdinSpool = spool.Name()
+		_, err = io.Copy(spool, os.Stdin)
+		spool.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return os.Open(fsm.stdinSpool)
+}
+
+// openWithRetry opens the provided file with open, trying again after delay up to attempts times
+// while it fails with EBUSY or EAGAIN, which mean the file is only locked for the moment
+func openWithRetry(open func(string) (*os.File, error), fileName string, attempts int, delay time.Duration) (*os.File, error) {
+	for attempt := 1; ; attempt++ {
+		file, err := open(fileName)
+		if err == nil || attempt >= attempts || !(errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EAGAIN)) {
+			return file, err
+		}
+		time.Sleep(delay)
+	}
+}
+
+// checkSymlink applies the symlink policy to the provided file
+// It returns whether the file should be skipped, and an error if the policy rejects it
+func (fsm *ClientFSM) checkSymlink(fileName string) (bool, error) {
+	if fsm.symlinks == SymlinkFollow || fileName == stdinFileName {
+		return false, nil
+	}
+	info, err := os.Lstat(fileName)
+	if err != nil {
+		return false, err
+	}
+	if info.Mode() & os.ModeSymlink == 0 {
+		return false, nil
+	}
+	if fsm.symlinks == SymlinkSkip {
+		return true, nil
+	}
+	return false, errors.New("file is a symbolic link")
+}
+
 func (fsm *ClientFSM) SendFileNameState() ClientState {
+	fileName := fsm.fileNames[fsm.currentFile]
 	fileInfo, err := fsm.file.Stat()
 	if err != nil {
-		fsm.err = err
+		fsm.err = fmt.Errorf("stat file %q: %w", fileName, err)
 		fsm.file.Close()
 		return HandleError
 	}
-	fname := []byte(fileInfo.Name())
-	_, fsm.err = sendBytes(fsm.writer, fname)
-	if fsm.err != nil {
+	fsm.fileSize = fileInfo.Size()
+	// anything that can fail without the server being at fault happens before the header is started,
+	// since HandleError skips the file by sending a status the server would otherwise read as part of it
+	var key uint32
+	if fsm.resumeByContent {
+		key, err = contentKey(fsm.file)
+		if err != nil {
+			fsm.err = fmt.Errorf("checksum %q: %w", fileName, err)
+			fsm.file.Close()
+			return HandleError
+		}
+	}
+	err = sendInt(fsm.writer, filePresent)
+	if err == nil {
+		fname := []byte(fsm.storedNames[fsm.currentFile])
+		_, err = sendBytes(fsm.writer, fname, fsm.bufferSize)
+	}
+	if err == nil {
+		err = sendInt(fsm.writer, int(fileInfo.Mode().Perm()))
+	}
+	if err == nil {
+		err = sendInt64(fsm.writer, fileInfo.ModTime().UnixNano())
+	}
+	if err == nil {
+		err = sendInt64(fsm.writer, fsm.fileSize)
+	}
+	uid, gid := -1, -1
+	if fsm.sendOwner {
+		if owner, group, ok := fileOwner(fileInfo); ok {
+			uid, gid = owner, group
+		}
+	}
+	if err == nil {
+		err = sendInt(fsm.writer, uid)
+	}
+	if err == nil {
+		err = sendInt(fsm.writer, gid)
+	}
+	if err == nil {
+		err = sendBool(fsm.writer, fsm.resumeByContent)
+	}
+	if err == nil && fsm.resumeByContent {
+		err = sendInt(fsm.writer, int(key))
+	}
+	if err == nil {
+		_, err = sendBytes(fsm.writer, []byte(fsm.fileKeys[fsm.currentFile]), fsm.bufferSize)
+	}
+	if err != nil {
+		fsm.err = fmt.Errorf("send header of %q: %w", fileName, serverClosed(err))
+		fsm.file.Close()
+		return Reconnect
+	}
+	return ReceiveOffset
+
+}
+
+// ReceiveOffsetState reads how many bytes of the file the server already has
+// from an earlier interrupted transfer and seeks past them
+func (fsm *ClientFSM) ReceiveOffsetState() ClientState {
+	var err error
+	fsm.offset, err = receiveInt64(fsm.reader)
+	if err != nil {
+		fsm.err = fmt.Errorf("read offset of %q: %w", fsm.fileNames[fsm.currentFile], err)
+		fsm.file.Close()
+		return Reconnect
+	}
+	if fsm.offset == alreadyStored {
+		fsm.logger.Info("server already stored file on an earlier attempt", "name", fsm.fileNames[fsm.currentFile])
+		fsm.file.Close()
+		fsm.lastSent = 0
+		return ReceiveAck
+	}
+	if fsm.offset == fileRejected {
+		fsm.file.Close()
+		fsm.lastSent = 0
+		return ReceiveAck
+	}
+	if fsm.offset < 0 || fsm.offset > fsm.fileSize {
+		fsm.file.Close()
+		fsm.err = fmt.Errorf("server has %d bytes of %s which is only %d bytes, remove the partial file on the server",
+			fsm.offset, fsm.fileNames[fsm.currentFile], fsm.fileSize)
+		return HandleFatalError
+	}
+	if fsm.offset > 0 {
+		return fsm.confirmResume()
+	}
+	return ReadAndSendFileData
+}
+
+// confirmResume checks the checksum the server sent of the part it already has against the start
+// of the file, and tells the server to resume from the offset if they match or to start over if not
+// the checksum sent after the content only covers the rest, so this is what keeps a stale
+// partial file on the server out of the stored file
+func (fsm *ClientFSM) confirmResume() ClientState {
+	fileName := fsm.fileNames[fsm.currentFile]
+	partial, err := receiveInt(fsm.reader)
+	if err != nil {
+		fsm.err = fmt.Errorf("read checksum of the part of %q the server has: %w", fileName, err)
 		fsm.file.Close()
-		return HandleFatalError }
+		return Reconnect
+	}
+	offered := fsm.offset
+	checksum := crc32.NewIEEE()
+	_, err = io.CopyN(checksum, fsm.file, offered)
+	if err == nil && checksum.Sum32() != uint32(partial) {
+		fsm.logger.Warn("server's partial file doesn't match, sending the whole file", "name", fileName, "offset", fsm.offset)
+		fsm.offset = resumeRestart
+		_, err = fsm.file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		fsm.err = fmt.Errorf("read the first %d bytes of %q: %w", offered, fileName, err)
+		fsm.file.Close()
+		return HandleFatalError
+	}
+	err = sendInt64(fsm.writer, fsm.offset)
+	if err != nil {
+		fsm.err = fmt.Errorf("send resume offset of %q: %w", fileName, err)
+		fsm.file.Close()
+		return Reconnect
+	}
+	if fsm.offset > 0 {
+		fsm.logger.Info("resuming file", "name", fileName, "offset", fsm.offset)
+	}
 	return ReadAndSendFileData
+}
+
+func (fsm *ClientFSM) ReadAndSendFileDataState() ClientState {
+	fileName := fsm.fileNames[fsm.currentFile]
+	var flags byte
+	if fsm.compress {
+		flags |= contentCompressed
+	}
+	if fsm.chunkAck {
+		flags |= contentChunkAck
+	}
+	if fsm.sparse {
+		flags |= contentSparse
+	}
+	err := fsm.writer.WriteByte(flags)
+	if err == nil && fsm.chunkAck {
+		err = sendInt(fsm.writer, fsm.bufferSize)
+	}
+	if err == nil {
+		err = fsm.writer.Flush()
+	}
+	if err != nil {
+		fsm.err = fmt.Errorf("send content flags of %q: %w", fileName, err)
+		fsm.file.Close()
+		return Reconnect
+	}
 
+	var acks *bufio.Reader
+	if fsm.chunkAck {
+		acks = fsm.reader
+	}
+	send := func(writer *bufio.Writer, reader io.Reader, size int64, bufferSize int, onChunk func(sent int64)) (int64, error) {
+		return sendStream(writer, reader, size, bufferSize, acks, onChunk)
+	}
+	if fsm.compress {
+		send = sendCompressed
+	} else if fsm.sparse {
+		send = sendSparse
+	}
+	checksum := crc32.NewIEEE()
+	reader := &rateLimitedReader{reader: fsm.file, limiter: fsm.limiter}
+	var sentSoFar int64
+	sent, err := send(fsm.writer, io.TeeReader(reader, checksum), fsm.fileSize - fsm.offset, fsm.bufferSize, func(sent int64) {
+		sentSoFar = sent
+		fsm.logger.Debug("chunk sent", "name", fileName, "bytes", fsm.offset + sent, "total", fsm.fileSize)
+		fsm.progress(fileName, fsm.offset + sent, fsm.fileSize)
+	})
+	if err != nil {
+		err = serverClosed(err)
+		if errors.Is(err, errServerClosed) && fsm.ctx.Err() == nil {
+			fsm.logger.Warn("server closed connection mid-transfer", "name", fileName, "bytes", fsm.offset + sentSoFar, "total", fsm.fileSize)
+		}
+		fsm.err = fmt.Errorf("send content of %q: %w", fileName, err)
+		fsm.file.Close()
+		return Reconnect
+	}
+	fsm.file.Close()
+	err = sendInt(fsm.writer, int(checksum.Sum32()))
+	if err != nil {
+		fsm.err = fmt.Errorf("send checksum of %q: %w", fileName, err)
+		return Reconnect
+	}
+	fsm.lastSent = sent
+	return ReceiveAck
 }
 
-func (fsm *ClientFSM) ReadAndSendFileDataState() ClientState {
-	fileData, err := os.ReadFile(fsm.fileNames[fsm.currentFile])
-
+// ReceiveAckState reads whether the server stored the file just sent
+func (fsm *ClientFSM) ReceiveAckState() ClientState {
+	status, err := fsm.reader.ReadByte()
 	if err != nil {
-		fsm.err = err
-		fsm.file.Close()
-		return HandleError
+		fsm.err = fmt.Errorf("read acknowledgement for %q: %w", fsm.fileNames[fsm.currentFile], err)
+		return Reconnect
 	}
-	_, fsm.err = sendBytes(fsm.writer, fileData)
-	if fsm.err != nil {
-		fsm.file.Close()
-		return HandleFatalError
+	reason := ackReason(status)
+	if status == ackRejected {
+		message, err := receiveBytes(fsm.reader, maxReasonLength)
+		if err != nil {
+			fsm.err = fmt.Errorf("read why %q was rejected: %w", fsm.fileNames[fsm.currentFile], err)
+			return Reconnect
+		}
+		reason = fmt.Sprintf("%s: %s", reason, message)
+	}
+	fsm.attempt = 0
+	if status == ackOK {
+		fsm.logger.Info("file sent", "name", fsm.fileNames[fsm.currentFile], "bytes", fsm.lastSent)
+		if fsm.stored == nil {
+			fsm.stored = make([]bool, len(fsm.fileNames))
+		}
+		fsm.stored[fsm.currentFile] = true
+		fsm.record("sent", fsm.lastSent, nil)
+		fsm.filesSent++
+		fsm.bytesSent += fsm.lastSent
+	} else {
+		fsm.logger.Error("server did not store file", "name", fsm.fileNames[fsm.currentFile], "reason", reason)
+		fsm.record("failed", fsm.lastSent, errors.New(reason))
+		fsm.filesFailed++
 	}
-	fsm.file.Close()
-	println("Sent file " + fsm.fileNames[fsm.currentFile])
 	fsm.currentFile++
-
 	return SendNextFile
 }
 
+// SendNextFileState moves on to the next file, first reconnecting if the server
+// dropped the connection after the last file, so the rest of the batch isn't lost
 func (fsm *ClientFSM) SendNextFileState() ClientState {
 	if fsm.currentFile >= len(fsm.fileNames) {
+		if fsm.verify && fsm.stored != nil {
+			// the server ends the connection after the last file, so verify over a new one
+			fsm.verifying = true
+			fsm.con.Close()
+			return ConnetServer
+		}
 		return Terminate
 	}
+	if !fsm.connectionAlive() {
+		fsm.err = fmt.Errorf("before sending %q: %w", fsm.fileNames[fsm.currentFile], errServerClosed)
+		return Reconnect
+	}
 	return OpenFile
 }
 
+// connectionAlive reports whether the server still has the connection open
+// the server sends nothing between files, so a read that doesn't time out right away means it closed
+func (fsm *ClientFSM) connectionAlive() bool {
+	fsm.con.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := fsm.reader.Peek(1)
+	fsm.con.SetReadDeadline(time.Time{})
+	return err == nil || errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// ReconnectState drops the broken connection and dials the server again after an exponential backoff,
+// resending the file that failed, whose already received part the server resumes from
+// It gives up once the configured number of retries is used up, so -retries 0 never reconnects
+func (fsm *ClientFSM) ReconnectState() ClientState {
+	if fsm.attempt >= fsm.retries {
+		return HandleFatalError
+	}
+	delay := fsm.retryDelay << fsm.attempt
+	fsm.attempt++
+	fsm.logger.Warn("connection failed, retrying", "err", fsm.err, "attempt", fsm.attempt, "delay", delay)
+	if fsm.con != nil {
+		fsm.con.Close()
+	}
+	select {
+	case <-time.After(delay):
+	case <-fsm.ctx.Done():
+	}
+	return ConnetServer
+}
+
 func (fsm *ClientFSM) HandleFatalErrorState() ClientState {
-	log.Println("Fatal Error:", fsm.err)
+	if errors.Is(fsm.err, syscall.ECONNREFUSED) {
+		fsm.logger.Error(fmt.Sprintf("could not connect: is the server running at %s?", fsm.address))
+	}
+	fsm.logger.Error("fatal error", "err", fsm.err)
+	fsm.initResults()
+	for i := range fsm.results {
+		if fsm.results[i].Status == "not sent" && fsm.results[i].Error == "" {
+			fsm.results[i].Error = fsm.err.Error()
+		}
+	}
 	return Terminate
 }
 
-func (fsm *ClientFSM) HandleFileError() ClientState {
-	fmt.Println("Error:", fsm.err)
-	fsm.currentFile++ //need to check if this is correct
+// HandleErrorState logs why the current file can't be sent and skips it
+// it is only entered before the file's header is started, so the server is expecting a file status
+func (fsm *ClientFSM) HandleErrorState() ClientState {
+	fsm.logger.Error("skipping file", "name", fsm.fileNames[fsm.currentFile], "err", fsm.err)
+	return fsm.skipFile(fsm.err)
+}
+
+// skipFile tells the server the current file won't be sent and moves on to the next one
+// reason is why it was skipped, nil when it was skipped on purpose
+func (fsm *ClientFSM) skipFile(reason error) ClientState {
+	err := sendInt(fsm.writer, fileSkipped)
+	if err != nil {
+		fsm.err = fmt.Errorf("tell server %q is skipped: %w", fsm.fileNames[fsm.currentFile], err)
+		return HandleFatalError
+	}
+	fsm.record("skipped", 0, reason)
+	fsm.filesSkipped++
+	// the server counts a skipped file as one of those announced, so it is done with just like a sent one
+	fsm.currentFile++
 	return SendNextFile
 }
 
+// initResults marks every file as not sent unless its result was already recorded
+func (fsm *ClientFSM) initResults() {
+	if fsm.results != nil {
+		return
+	}
+	fsm.results = make([]FileResult, len(fsm.fileNames))
+	for i, fileName := range fsm.fileNames {
+		fsm.results[i] = FileResult{Name: fileName, Status: "not sent"}
+	}
+}
+
+// record sets the result of the current file, err is nil unless it failed or was skipped because of an error
+func (fsm *ClientFSM) record(status string, bytes int64, err error) {
+	fsm.initResults()
+	result := &fsm.results[fsm.currentFile]
+	result.Status, result.Bytes, result.Error = status, bytes, ""
+	if err != nil {
+		result.Error = err.Error()
+	}
+}
+
 func (fsm *ClientFSM) TerminateState() {
+	if fsm.stopClosing != nil {
+		fsm.stopClosing()
+	}
+	if fsm.file != nil {
+		fsm.file.Close()
+	}
+	// every state flushes what it sends, so nothing should be left in the writer by now,
+	// flush anyway so a state that forgets to can't silently drop the end of the stream
+	if fsm.writer != nil && fsm.writer.Buffered() > 0 {
+		if err := fsm.writer.Flush(); err != nil && fsm.ctx.Err() == nil {
+			fsm.logger.Warn("could not send buffered data before closing", "bytes", fsm.writer.Buffered(), "err", err)
+		}
+	}
 	if fsm.con != nil {
 		fsm.con.Close()
 	}
-	fmt.Println("Client Exiting...")
+	if fsm.con != nil && !fsm.status {
+		elapsed := time.Since(fsm.started)
+		fsm.logger.Info(fmt.Sprintf("Transferred %d/%d files, %s in %s (%s)", fsm.filesSent, len(fsm.fileNames),
+			formatSize(fsm.bytesSent), elapsed.Round(time.Millisecond), formatRate(fsm.bytesSent, elapsed)),
+			"sent", fsm.filesSent, "skipped", fsm.filesSkipped, "failed", fsm.filesFailed, "bytes", fsm.bytesSent)
+	}
+	if fsm.jsonOutput && !fsm.status && !fsm.dryRun && !fsm.manifestOnly {
+		fsm.initResults()
+		output, err := json.MarshalIndent(fsm.results, "", "  ")
+		if err == nil {
+			fmt.Println(string(output))
+		} else {
+			fsm.logger.Error("could not encode results", "err", err)
+		}
+	}
+	if fsm.stdinSpool != "" {
+		os.Remove(fsm.stdinSpool)
+	}
+	if fsm.sigChan != nil {
+		signal.Stop(fsm.sigChan)
+	}
+	fsm.cancel()
+	fsm.logger.Info("client exiting")
+}
+
+// handleSignal cancels the client's context on SIGINT or SIGTERM
+// It returns without doing anything once the client has terminated on its own
+func (fsm *ClientFSM) handleSignal() {
+	select {
+	case <-fsm.sigChan:
+		fsm.logger.Warn("interrupted, stopping")
+		fsm.cancel()
+	case <-fsm.ctx.Done():
+	}
 }
 
-func (fsm *ClientFSM) Run() {
+// Run drives the client state machine until it terminates
+// It returns the error that caused a fatal termination, nil if the client exited normally
+func (fsm *ClientFSM) Run() error {
+	if fsm.started.IsZero() {
+		fsm.started = time.Now()
+	}
+	var fatalErr error
 	for {
+		if err := fsm.ctx.Err(); err != nil && fsm.currentState != Terminate {
+			if fatalErr == nil {
+				fatalErr = errInterrupted
+				if errors.Is(err, context.DeadlineExceeded) {
+					fsm.logger.Warn("deadline reached, stopping", "deadline", fsm.runDeadline)
+					fatalErr = errDeadline
+				}
+			}
+			fsm.currentState = Terminate
+		}
 		switch fsm.currentState {
 		case ValidateArgs:
 			fsm.currentState = fsm.ValidateArgsState()
+		case CheckTotalSize:
+			fsm.currentState = fsm.CheckTotalSizeState()
+		case DryRun:
+			fsm.currentState = fsm.DryRunState()
+		case ManifestOnly:
+			fsm.currentState = fsm.ManifestOnlyState()
 		case ParseIP:
 			fsm.currentState = fsm.ParseIPState()
+		case ParallelUpload:
+			fsm.currentState = fsm.ParallelUploadState()
 		case ConnetServer:
 			fsm.currentState = fsm.ConnetServerState()
+		case SendHandshake:
+			fsm.currentState = fsm.SendHandshakeState()
+		case QueryStatus:
+			fsm.currentState = fsm.QueryStatusState()
+		case QueryFiles:
+			fsm.currentState = fsm.QueryFilesState()
+		case VerifyUpload:
+			fsm.currentState = fsm.VerifyUploadState()
 		case SendFileCount:
 			fsm.currentState = fsm.SendFileCountState()
 		case OpenFile:
 			fsm.currentState = fsm.OpenFileState()
 		case SendFileName:
 			fsm.currentState = fsm.SendFileNameState()
+		case ReceiveOffset:
+			fsm.currentState = fsm.ReceiveOffsetState()
 		case ReadAndSendFileData:
 			fsm.currentState = fsm.ReadAndSendFileDataState()
+		case ReceiveAck:
+			fsm.currentState = fsm.ReceiveAckState()
 		case SendNextFile:
 			fsm.currentState = fsm.SendNextFileState()
+		case Reconnect:
+			fsm.currentState = fsm.ReconnectState()
 		case HandleFatalError:
+			fatalErr = fsm.err
 			fsm.currentState = fsm.HandleFatalErrorState()
 		case HandleError:
-			fsm.currentState = fsm.HandleFileError()
+			fsm.currentState = fsm.HandleErrorState()
 		case Terminate:
 			fsm.TerminateState()
-			return
+			return fatalErr
 		}
 	}
 }
@@ -208,13 +1506,26 @@ func sendInt(writer *bufio.Writer, num int) (error) {
 	return writer.Flush()
 }
 
-// sendBytes sends the provided byte array to the provided writer
+// sendInt64 encodes the provided 64 bit integer using big endian and sends it to the provided writer
+// It returns an error if the writer cannot be written to
+// error will be nil if there's no error
+func sendInt64(writer *bufio.Writer, num int64) error {
+	sendBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(sendBytes, uint64(num))
+	_, err := writer.Write(sendBytes)
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// sendBytes sends the provided byte array to the provided writer in chunks of bufferSize
 // It returns an int of the number of data it send, and error if the writer cannot be written to
 // error will be nil if there's no error
-func sendBytes(writer *bufio.Writer, data []byte) (int, error) {
+func sendBytes(writer *bufio.Writer, data []byte, bufferSize int) (int, error) {
 	err := sendInt(writer, len(data))
 	if err != nil {
-		return -1, err
+		return -1, serverClosed(err)
 	}
 
 	for start := 0; start < len(data); start += bufferSize {
@@ -225,6 +1536,52 @@ func sendBytes(writer *bufio.Writer, data []byte) (int, error) {
 
 		chunk := data[start:end]
 		_, err := writer.Write(chunk)
+		if err != nil {
+			return -1, serverClosed(err)
+		}
+		err = writer.Flush()
+		if err != nil {
+			return -1, serverClosed(err)
+		}
+	}
+	return len(data), nil
+}
+
+
+// serverClosed wraps err with errServerClosed when it means the server has closed the connection,
+// a broken pipe or reset when writing, and returns any other error unchanged
+func serverClosed(err error) error {
+	if errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("%w: %w", errServerClosed, err)
+	}
+	return err
+}
+
+// sendStream sends size bytes read from the provided reader to the provided writer,
+// prefixed with the total length, in chunks of bufferSize so the whole file never sits in memory
+// onChunk is called with the running total after each chunk is flushed
+// if acks isn't nil, each chunk waits for the server's chunkReceived from it before the next is sent
+// It returns the number of bytes it sent, and error if the reader or writer fails
+// error will be nil if there's no error
+func sendStream(writer *bufio.Writer, reader io.Reader, size int64, bufferSize int, acks *bufio.Reader, onChunk func(sent int64)) (int64, error) {
+	err := sendInt64(writer, size)
+	if err != nil {
+		return -1, err
+	}
+
+	buffer := make([]byte, bufferSize)
+	var sent int64
+	for sent < size {
+		chunkSize := int64(bufferSize)
+		if size - sent < chunkSize {
+			chunkSize = size - sent
+		}
+
+		n, err := io.ReadFull(reader, buffer[:chunkSize])
+		if err != nil {
+			return -1, err
+		}
+		_, err = writer.Write(buffer[:n])
 		if err != nil {
 			return -1, err
 		}
@@ -232,11 +1589,532 @@ func sendBytes(writer *bufio.Writer, data []byte) (int, error) {
 		if err != nil {
 			return -1, err
 		}
+		if acks != nil {
+			ack, err := acks.ReadByte()
+			if err != nil {
+				return -1, fmt.Errorf("read chunk acknowledgement: %w", err)
+			}
+			if ack != chunkReceived {
+				return -1, fmt.Errorf("unexpected chunk acknowledgement %d", ack)
+			}
+		}
+		sent += int64(n)
+		onChunk(sent)
+	}
+	return sent, nil
+}
+
+// sendSparse sends size bytes read from the provided reader to the provided writer as a sequence
+// of chunks of up to bufferSize, each prefixed by its length and terminated by an empty chunk
+// a chunk holding nothing but zeros is sent as its negated length alone, which the server
+// skips over instead of writing, so holes in the file cost neither bandwidth nor disk space
+// onChunk is called with the running total, holes included, after each chunk is flushed
+// It returns the number of bytes it sent, holes included, and error if the reader or writer fails
+func sendSparse(writer *bufio.Writer, reader io.Reader, size int64, bufferSize int, onChunk func(sent int64)) (int64, error) {
+	buffer := make([]byte, bufferSize)
+	var sent int64
+	for sent < size {
+		chunkSize := int64(bufferSize)
+		if size - sent < chunkSize {
+			chunkSize = size - sent
+		}
+
+		n, err := io.ReadFull(reader, buffer[:chunkSize])
+		if err != nil {
+			return -1, err
+		}
+		if isZero(buffer[:n]) {
+			err = sendInt(writer, -n)
+		} else {
+			err = sendInt(writer, n)
+			if err == nil {
+				_, err = writer.Write(buffer[:n])
+			}
+			if err == nil {
+				err = writer.Flush()
+			}
+		}
+		if err != nil {
+			return -1, err
+		}
+		sent += int64(n)
+		onChunk(sent)
+	}
+	return sent, sendInt(writer, 0)
+}
+
+// isZero reports whether data holds nothing but zeros
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sendCompressed gzips size bytes read from the provided reader and sends them to the provided writer
+// as a sequence of length prefixed chunks terminated by an empty chunk, since the compressed length isn't known upfront
+// onChunk is called with the running total of uncompressed bytes after each chunk is read
+// It returns the number of uncompressed bytes it sent, and error if the reader or writer fails
+// error will be nil if there's no error
+func sendCompressed(writer *bufio.Writer, reader io.Reader, size int64, bufferSize int, onChunk func(sent int64)) (int64, error) {
+	compressor := gzip.NewWriter(&chunkWriter{writer: writer, bufferSize: bufferSize})
+	buffer := make([]byte, bufferSize)
+	var sent int64
+	for sent < size {
+		chunkSize := int64(bufferSize)
+		if size - sent < chunkSize {
+			chunkSize = size - sent
+		}
+
+		n, err := io.ReadFull(reader, buffer[:chunkSize])
+		if err != nil {
+			return -1, err
+		}
+		_, err = compressor.Write(buffer[:n])
+		if err != nil {
+			return -1, err
+		}
+		sent += int64(n)
+		onChunk(sent)
+	}
+	err := compressor.Close()
+	if err != nil {
+		return -1, err
+	}
+	return sent, sendInt(writer, 0)
+}
+
+// chunkWriter sends every write to the underlying writer as a length prefixed chunk
+type chunkWriter struct {
+	writer     *bufio.Writer
+	bufferSize int
+}
+
+func (w *chunkWriter) Write(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	_, err := sendBytes(w.writer, data, w.bufferSize)
+	if err != nil {
+		return 0, err
 	}
 	return len(data), nil
 }
 
+// tuneConnection disables Nagle's algorithm so small files aren't delayed, and enables TCP keep-alive
+// with the provided period so dead peers are detected, a period of 0 or less disables keep-alive
+// connections that aren't TCP, such as in tests, are left alone
+func tuneConnection(con net.Conn, keepAlive time.Duration) error {
+	if tlsCon, ok := con.(*tls.Conn); ok {
+		con = tlsCon.NetConn()
+	}
+	tcpCon, ok := con.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	err := tcpCon.SetNoDelay(true)
+	if err != nil {
+		return err
+	}
+	if keepAlive <= 0 {
+		return tcpCon.SetKeepAlive(false)
+	}
+	err = tcpCon.SetKeepAlive(true)
+	if err != nil {
+		return err
+	}
+	return tcpCon.SetKeepAlivePeriod(keepAlive)
+}
+
+// rateLimiter is a token bucket refilled at a fixed number of bytes per second
+// holding at most one second worth of tokens, a nil limiter never blocks
+// it is safe for concurrent use, so parallel connections can share one limit
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter for the provided rate, or nil if the rate isn't positive
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(bytesPerSecond), last: time.Now()}
+}
+
+// wait takes n bytes worth of tokens, sleeping until the bucket has refilled enough
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	// the debt is taken under the lock, so concurrent callers queue up behind each other while sleeping
+	debt := -l.tokens
+	l.mu.Unlock()
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / l.rate * float64(time.Second)))
+	}
+}
+
+// rateLimitedReader throttles reads from the underlying reader with the provided limiter
+type rateLimitedReader struct {
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(data []byte) (int, error) {
+	n, err := r.reader.Read(data)
+	r.limiter.wait(n)
+	return n, err
+}
+
+// sendBool sends the provided flag as a single byte to the provided writer
+// It returns an error if the writer cannot be written to
+func sendBool(writer *bufio.Writer, flag bool) error {
+	var value byte
+	if flag {
+		value = 1
+	}
+	err := writer.WriteByte(value)
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// ackReason describes the provided acknowledgement code
+func ackReason(status byte) string {
+	switch status {
+	case ackChecksumMismatch:
+		return "checksum mismatch"
+	case ackWriteFailed:
+		return "server could not write the file"
+	case ackExists:
+		return "file already exists on the server"
+	case ackRejected:
+		return "rejected by the server"
+	}
+	return fmt.Sprintf("unknown status %d", status)
+}
+
+// fileOwner returns the user and group IDs owning the file described by info
+// They come from the platform's syscall.Stat_t, so ok is false on platforms without one, such as Windows
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	stat := reflect.Indirect(reflect.ValueOf(info.Sys()))
+	if stat.Kind() != reflect.Struct {
+		return -1, -1, false
+	}
+	uidField, gidField := stat.FieldByName("Uid"), stat.FieldByName("Gid")
+	if !uidField.IsValid() || !gidField.IsValid() || !uidField.CanUint() || !gidField.CanUint() {
+		return -1, -1, false
+	}
+	return int(uidField.Uint()), int(gidField.Uint()), true
+}
+
+// formatSize formats a byte count using the largest fitting unit, e.g. 12.4 MB
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// formatRate formats the rate at which the provided bytes were sent in the elapsed time, e.g. 12.4 MB/s
+func formatRate(bytes int64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "-"
+	}
+	return formatSize(int64(float64(bytes) / elapsed.Seconds())) + "/s"
+}
+
+// printProgress prints the percentage of the file sent so far to stderr
+func printProgress(fileName string, bytesSent, totalBytes int64) {
+	percent := int64(100)
+	if totalBytes > 0 {
+		percent = bytesSent * 100 / totalBytes
+	}
+	fmt.Fprintf(os.Stderr, "\r%s: %d%%", fileName, percent)
+	if bytesSent == totalBytes {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// expandFileLists replaces every @listfile argument with the paths listed in that file, one per line
+// blank lines and lines starting with # are ignored, relative paths are relative to the working directory
+func expandFileLists(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") {
+			paths = append(paths, arg)
+			continue
+		}
+
+		list, err := os.Open(arg[1:])
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(list)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			paths = append(paths, line)
+		}
+		err = scanner.Err()
+		list.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// expandGlobs replaces every argument containing *, ? or [ with the paths it matches, in lexical order
+// so patterns work even when the shell did not expand them; a path that exists as written is kept as is
+func expandGlobs(paths []string) ([]string, error) {
+	var expanded []string
+	for _, path := range paths {
+		if path == stdinFileName || !strings.ContainsAny(path, "*?[") {
+			expanded = append(expanded, path)
+			continue
+		}
+		if _, err := os.Lstat(path); err == nil {
+			expanded = append(expanded, path)
+			continue
+		}
+
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %s: %w", path, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("pattern %s matches no files", path)
+		}
+		expanded = append(expanded, matches...)
+	}
+	return expanded, nil
+}
+
+// expandPaths walks any directories among the provided paths and returns every file to send
+// along with the name each file is stored under on the server
+// files inside a directory keep their path relative to the directory's parent, using forward slashes
+// with keepPaths every file keeps the relative path it was given by instead
+// It returns an error if keepPaths is set and a path is absolute or leaves the current directory
+func expandPaths(paths []string, keepPaths bool) ([]string, []string, error) {
+	var fileNames, storedNames []string
+	for _, path := range paths {
+		if keepPaths && path != stdinFileName && !filepath.IsLocal(path) {
+			return nil, nil, fmt.Errorf("can't keep the path of %s, it must be relative and inside the current directory", path)
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() {
+			fileNames = append(fileNames, path)
+			if keepPaths {
+				storedNames = append(storedNames, filepath.ToSlash(filepath.Clean(path)))
+			} else {
+				storedNames = append(storedNames, filepath.Base(path))
+			}
+			continue
+		}
+
+		parent := filepath.Dir(filepath.Clean(path))
+		if keepPaths {
+			parent = "."
+		}
+		err = filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(parent, file)
+			if err != nil {
+				return err
+			}
+			fileNames = append(fileNames, file)
+			storedNames = append(storedNames, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return fileNames, storedNames, nil
+}
+
+// parseCutoff returns the time written in RFC 3339 by the provided value, or the time that long before now
+// when it is a duration such as 90m
+func parseCutoff(value string, now time.Time) (time.Time, error) {
+	if cutoff, err := time.Parse(time.RFC3339, value); err == nil {
+		return cutoff, nil
+	}
+	ago, err := time.ParseDuration(value)
+	if err != nil || ago < 0 {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or a duration such as 24h", value)
+	}
+	return now.Add(-ago), nil
+}
+
+// filterNewer returns the files, along with the names they are stored under, last modified after cutoff
+// files that can't be stat'ed and standard input are kept, so they are reported or read as usual
+func filterNewer(fileNames, storedNames []string, cutoff time.Time) ([]string, []string) {
+	var keptFiles, keptNames []string
+	for i, fileName := range fileNames {
+		if fileName != stdinFileName {
+			info, err := os.Stat(fileName)
+			if err == nil && !info.ModTime().After(cutoff) {
+				continue
+			}
+		}
+		keptFiles = append(keptFiles, fileName)
+		keptNames = append(keptNames, storedNames[i])
+	}
+	return keptFiles, keptNames
+}
+
+// idempotencyKeys returns a key for each of count files, unique to this run
+func idempotencyKeys(count int) ([]string, error) {
+	run := make([]byte, 8)
+	_, err := rand.Read(run)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s-%d", hex.EncodeToString(run), i)
+	}
+	return keys, nil
+}
+
+// sortFiles sorts the files, along with the names they are stored under, in the provided order
+// for size and mtime, files that can't be stat'ed and standard input go last, in the order given
+func sortFiles(fileNames, storedNames []string, order SortOrder) {
+	if order == SortNone {
+		return
+	}
+	infos := make(map[string]os.FileInfo, len(fileNames))
+	if order != SortName {
+		for _, fileName := range fileNames {
+			if fileName == stdinFileName {
+				continue
+			}
+			if info, err := os.Stat(fileName); err == nil {
+				infos[fileName] = info
+			}
+		}
+	}
+	indexes := make([]int, len(fileNames))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(a, b int) bool {
+		nameA, nameB := fileNames[indexes[a]], fileNames[indexes[b]]
+		if order == SortName {
+			return nameA < nameB
+		}
+		infoA, infoB := infos[nameA], infos[nameB]
+		if infoA == nil || infoB == nil {
+			return infoA != nil && infoB == nil
+		}
+		if order == SortSize {
+			return infoA.Size() < infoB.Size()
+		}
+		return infoA.ModTime().Before(infoB.ModTime())
+	})
+	sortedFiles, sortedNames := make([]string, len(fileNames)), make([]string, len(storedNames))
+	for i, index := range indexes {
+		sortedFiles[i], sortedNames[i] = fileNames[index], storedNames[index]
+	}
+	copy(fileNames, sortedFiles)
+	copy(storedNames, sortedNames)
+}
+
+// fileMatches reports whether the provided file has the provided size and CRC32
+// the checksum is only computed when the sizes match
+func fileMatches(file *os.File, size int64, checksum uint32) bool {
+	info, err := file.Stat()
+	if err != nil || info.Size() != size {
+		return false
+	}
+	local := crc32.NewIEEE()
+	_, err = io.Copy(local, file)
+	return err == nil && local.Sum32() == checksum
+}
+
+// contentKey returns the CRC32 of the whole provided file, which the server resumes it by
+// and -manifest-only prints, and leaves the file positioned at its start
+func contentKey(file *os.File) (uint32, error) {
+	checksum := crc32.NewIEEE()
+	_, err := file.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(checksum, file)
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	return checksum.Sum32(), err
+}
+
+// receiveInt reads a big endian encoded 32 bit integer from the provided reader
+// It returns an error if the stream ends before all 4 bytes are read
+func receiveInt(reader *bufio.Reader) (int, error) {
+	receivedBytes := make([]byte, 4)
+	_, err := io.ReadFull(reader, receivedBytes)
+	if err != nil {
+		return -1, err
+	}
+	return int(binary.BigEndian.Uint32(receivedBytes)), nil
+}
+
+// receiveInt64 reads a big endian encoded 64 bit integer from the provided reader
+// It returns an error if the stream ends before all 8 bytes are read
+func receiveInt64(reader *bufio.Reader) (int64, error) {
+	receivedBytes := make([]byte, 8)
+	_, err := io.ReadFull(reader, receivedBytes)
+	if err != nil {
+		return -1, err
+	}
+	return int64(binary.BigEndian.Uint64(receivedBytes)), nil
+}
 
+// receiveBytes reads a length prefixed byte array from the provided reader
+// It returns an error if the length exceeds maxSize or the stream ends early
+func receiveBytes(reader *bufio.Reader, maxSize int) ([]byte, error) {
+	lengthBytes := make([]byte, 4)
+	_, err := io.ReadFull(reader, lengthBytes)
+	if err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lengthBytes)
+	if length > uint32(maxSize) {
+		return nil, fmt.Errorf("reply of %d bytes exceeds the limit of %d", length, maxSize)
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
 
 //validates the provided arguments
 //returns the ip, port, filenames and error
@@ -255,7 +2133,9 @@ func validateArgs(args []string) (ip string, port string, filenames []string, er
 
 func main(){
 
-	clientFSM := NewClientFSM()
-	clientFSM.Run()
+	clientFSM := NewClientFSM(nil, nil)
+	if err := clientFSM.Run(); err != nil {
+		os.Exit(1)
+	}
 
 }
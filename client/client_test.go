@@ -0,0 +1,1267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// logBuffer collects log output from several goroutines
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(data)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// fakeServer speaks the server's side of the protocol, keeping the files it receives in memory
+type fakeServer struct {
+	t        *testing.T
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu sync.Mutex
+	// files holds the content stored under each name
+	files map[string][]byte
+	// partials are offered for resuming the file of the same name
+	partials map[string][]byte
+	// resumedFrom is the offset each file was resumed from
+	resumedFrom map[string]int64
+	// reject names files the server refuses, with the reason sent for each
+	reject map[string]string
+	// ack, when not ackOK, is sent for every file whose content arrived intact
+	ack byte
+	// dropHeaders is how many more connections are closed right after reading a file header
+	dropHeaders int
+	// filesPerConnection closes each connection after this many files, 0 after the announced count
+	filesPerConnection int
+	// tamper answers queries with a checksum that matches nothing
+	tamper bool
+	// stall never answers the handshake
+	stall bool
+	// stallContent reads the content of every file without ever acknowledging a chunk
+	stallContent bool
+	connections int
+	received    int
+	skipped     int
+	chunkAcks   int
+}
+
+// startFakeServer listens on a free loopback port until the test ends
+func startFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+	listener, err := net.Listen(trans, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeServer{
+		t: t,
+		listener: listener,
+		files: make(map[string][]byte),
+		partials: make(map[string][]byte),
+		resumedFrom: make(map[string]int64),
+		reject: make(map[string]string),
+	}
+	server.wg.Add(1)
+	go server.serve()
+	t.Cleanup(func() {
+		listener.Close()
+		server.wg.Wait()
+	})
+	return server
+}
+
+// port returns the port the server listens on
+func (s *fakeServer) port() string {
+	return fmt.Sprint(s.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// file returns the content stored under name
+func (s *fakeServer) file(name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	content, ok := s.files[name]
+	return content, ok
+}
+
+func (s *fakeServer) serve() {
+	defer s.wg.Done()
+	for {
+		con, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.connections++
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer con.Close()
+			con.SetDeadline(time.Now().Add(10 * time.Second))
+			s.handle(bufio.NewReader(con), bufio.NewWriter(con))
+		}()
+	}
+}
+
+// handle serves one connection, returning when the connection should be closed
+func (s *fakeServer) handle(reader *bufio.Reader, writer *bufio.Writer) {
+	handshake := make([]byte, len(protocolMagic) + 1)
+	if _, err := io.ReadFull(reader, handshake); err != nil {
+		return
+	}
+	s.mu.Lock()
+	stall := s.stall
+	s.mu.Unlock()
+	if stall {
+		io.Copy(io.Discard, reader)
+		return
+	}
+	writer.WriteByte(handshakeOK)
+	writer.Flush()
+	if _, err := receiveBytes(reader, 4096); err != nil {
+		return
+	}
+	writer.WriteByte(destinationOK)
+	writer.Flush()
+
+	for {
+		count, err := receiveInt(reader)
+		if err != nil {
+			return
+		}
+		switch int32(count) {
+		case statusRequest:
+			sendBytes(writer, []byte(`{"files_received":0}`), defaultBufferSize)
+			return
+		case queryRequest:
+			if !s.answerQuery(reader, writer) {
+				return
+			}
+			continue
+		}
+		for i := 0; i < count; i++ {
+			s.mu.Lock()
+			limit := s.filesPerConnection
+			s.mu.Unlock()
+			if limit > 0 && i == limit {
+				return
+			}
+			if !s.receiveFile(reader, writer) {
+				return
+			}
+		}
+		return
+	}
+}
+
+// answerQuery answers a query for the files named after the count, as the server does
+func (s *fakeServer) answerQuery(reader *bufio.Reader, writer *bufio.Writer) bool {
+	count, err := receiveInt(reader)
+	if err != nil {
+		return false
+	}
+	for i := 0; i < count; i++ {
+		name, err := receiveBytes(reader, 4096)
+		if err != nil {
+			return false
+		}
+		content, ok := s.file(string(name))
+		if !ok {
+			writer.WriteByte(queryAbsent)
+			continue
+		}
+		checksum := crc32.ChecksumIEEE(content)
+		s.mu.Lock()
+		if s.tamper {
+			checksum++
+		}
+		s.mu.Unlock()
+		writer.WriteByte(queryPresent)
+		sendInt64(writer, int64(len(content)))
+		sendInt(writer, int(checksum))
+	}
+	return writer.Flush() == nil
+}
+
+// receiveFile reads one file and acknowledges it, returning false once the connection is done with
+func (s *fakeServer) receiveFile(reader *bufio.Reader, writer *bufio.Writer) bool {
+	status, err := receiveInt(reader)
+	if err != nil {
+		return false
+	}
+	if status == fileSkipped {
+		s.mu.Lock()
+		s.skipped++
+		s.mu.Unlock()
+		return true
+	}
+	nameBytes, err := receiveBytes(reader, 4096)
+	if err != nil {
+		return false
+	}
+	name := string(nameBytes)
+	receiveInt(reader)
+	receiveInt64(reader)
+	size, _ := receiveInt64(reader)
+	receiveInt(reader)
+	receiveInt(reader)
+	if keyed, _ := reader.ReadByte(); keyed == 1 {
+		receiveInt(reader)
+	}
+	if _, err := receiveBytes(reader, 4096); err != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	drop := s.dropHeaders > 0
+	if drop {
+		s.dropHeaders--
+	}
+	reason, rejected := s.reject[name]
+	partial, resumable := s.partials[name]
+	ack := s.ack
+	s.mu.Unlock()
+	if drop {
+		return false
+	}
+	if rejected {
+		sendInt64(writer, fileRejected)
+		writer.WriteByte(ackRejected)
+		sendBytes(writer, []byte(reason), defaultBufferSize)
+		return true
+	}
+	var base []byte
+	if resumable && len(partial) > 0 && int64(len(partial)) <= size {
+		sendInt64(writer, int64(len(partial)))
+		sendInt(writer, int(crc32.ChecksumIEEE(partial)))
+		offset, err := receiveInt64(reader)
+		if err != nil {
+			return false
+		}
+		base = partial[:offset]
+	} else {
+		sendInt64(writer, 0)
+	}
+	s.mu.Lock()
+	stallContent := s.stallContent
+	s.mu.Unlock()
+	if stallContent {
+		io.Copy(io.Discard, reader)
+		return false
+	}
+
+	content, err := s.receiveContent(reader, writer)
+	if err != nil {
+		return false
+	}
+	checksum, err := receiveInt(reader)
+	if err != nil {
+		return false
+	}
+	if uint32(checksum) != crc32.ChecksumIEEE(content) {
+		ack = ackChecksumMismatch
+	}
+	s.mu.Lock()
+	s.received++
+	s.resumedFrom[name] = int64(len(base))
+	if ack == ackOK {
+		s.files[name] = append(append([]byte{}, base...), content...)
+	}
+	s.mu.Unlock()
+	writer.WriteByte(ack)
+	return writer.Flush() == nil
+}
+
+// receiveContent reads the content flags and the content encoded as they say
+func (s *fakeServer) receiveContent(reader *bufio.Reader, writer *bufio.Writer) ([]byte, error) {
+	flags, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	chunkSize := 0
+	if flags & contentChunkAck != 0 {
+		chunkSize, err = receiveInt(reader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var content bytes.Buffer
+	switch {
+	case flags & contentCompressed != 0:
+		var compressed bytes.Buffer
+		for {
+			chunk, err := receiveBytes(reader, defaultBufferSize * 2)
+			if err != nil {
+				return nil, err
+			}
+			if len(chunk) == 0 {
+				break
+			}
+			compressed.Write(chunk)
+		}
+		decompressor, err := gzip.NewReader(&compressed)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(&content, decompressor)
+		return content.Bytes(), err
+	case flags & contentSparse != 0:
+		for {
+			length, err := receiveInt(reader)
+			if err != nil {
+				return nil, err
+			}
+			n := int32(length)
+			if n == 0 {
+				return content.Bytes(), nil
+			}
+			if n < 0 {
+				content.Write(make([]byte, -n))
+				continue
+			}
+			if _, err := io.CopyN(&content, reader, int64(n)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	length, err := receiveInt64(reader)
+	if err != nil {
+		return nil, err
+	}
+	if chunkSize == 0 {
+		_, err = io.CopyN(&content, reader, length)
+		return content.Bytes(), err
+	}
+	for int64(content.Len()) < length {
+		if _, err := io.CopyN(&content, reader, min(int64(chunkSize), length - int64(content.Len()))); err != nil {
+			return nil, err
+		}
+		writer.WriteByte(chunkReceived)
+		writer.Flush()
+		s.mu.Lock()
+		s.chunkAcks++
+		s.mu.Unlock()
+	}
+	return content.Bytes(), nil
+}
+
+// newTestClient returns a client that reads the provided arguments as its command line
+// and logs to logs, at the level its flags choose
+func newTestClient(t *testing.T, logs io.Writer, args ...string) *ClientFSM {
+	t.Helper()
+	previous := os.Args
+	os.Args = append([]string{"client"}, args...)
+	t.Cleanup(func() { os.Args = previous })
+	client := NewClientFSM(nil, nil)
+	client.logger = slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: client.logLevel}))
+	return client
+}
+
+// runClient runs a client with the provided arguments, discarding its logs
+func runClient(t *testing.T, args ...string) (*ClientFSM, error) {
+	t.Helper()
+	client := newTestClient(t, io.Discard, args...)
+	return client, client.Run()
+}
+
+// writeFile writes content to name in dir and returns its path
+func writeFile(t *testing.T, dir, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// captureStdout returns what run prints to stdout
+func captureStdout(t *testing.T, run func()) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := os.Stdout
+	os.Stdout = writer
+	output := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- data
+	}()
+	run()
+	os.Stdout = previous
+	writer.Close()
+	return string(<-output)
+}
+
+func TestReceiveIntSplitPrefix(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+	go func() {
+		serverSide.Write([]byte{0, 0})
+		time.Sleep(10 * time.Millisecond)
+		serverSide.Write([]byte{1, 2})
+	}()
+	got, err := receiveInt(bufio.NewReader(clientSide))
+	if err != nil || got != 0x0102 {
+		t.Fatalf("receiveInt = %d, %v, want %d", got, err, 0x0102)
+	}
+}
+
+func TestSendStreamLengthAboveUint32(t *testing.T) {
+	var stream bytes.Buffer
+	writer := bufio.NewWriter(&stream)
+	// the reader is empty so only the prefix is sent before the copy fails
+	sendStream(writer, bytes.NewReader(nil), math.MaxUint32 + 10, 1024, nil, func(int64) {})
+	got, err := receiveInt64(bufio.NewReader(&stream))
+	if err != nil || got != math.MaxUint32 + 10 {
+		t.Fatalf("length prefix = %d, %v, want %d", got, err, int64(math.MaxUint32 + 10))
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	server := startFakeServer(t)
+	server.stall = true
+	path := writeFile(t, t.TempDir(), "a.txt", nil)
+	started := time.Now()
+	_, err := runClient(t, "-timeout", "200ms", "-retries", "0", "127.0.0.1", server.port(), path)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Run = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if elapsed := time.Since(started); elapsed > 2 * time.Second {
+		t.Fatalf("client gave up %v after a 200ms timeout", elapsed)
+	}
+}
+
+func TestValidateArgs(t *testing.T) {
+	ip, port, files, err := validateArgs([]string{"127.0.0.1", "9000", "a.txt", "b.txt"})
+	if err != nil || ip != "127.0.0.1" || port != "9000" || len(files) != 2 {
+		t.Fatalf("validateArgs = %q, %q, %v, %v", ip, port, files, err)
+	}
+	if _, _, _, err := validateArgs([]string{"127.0.0.1", "9000"}); err == nil {
+		t.Fatal("validateArgs accepted arguments without a file")
+	}
+}
+
+func TestRunRejectsBadArguments(t *testing.T) {
+	for _, args := range [][]string{
+		{"127.0.0.1"},
+		{"127.0.0.1", "9000"},
+		{"-undefined", "127.0.0.1", "9000", "a.txt"},
+	} {
+		if _, err := runClient(t, args...); err == nil {
+			t.Errorf("client ran with %q", args)
+		}
+	}
+}
+
+func TestSendsFiles(t *testing.T) {
+	server := startFakeServer(t)
+	dir := t.TempDir()
+	a := writeFile(t, dir, "a.txt", []byte("first"))
+	b := writeFile(t, dir, "b.txt", []byte("second"))
+	logs := &logBuffer{}
+	if err := newTestClient(t, logs, "127.0.0.1", server.port(), a, b).Run(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"a.txt": "first", "b.txt": "second"} {
+		if got, _ := server.file(name); string(got) != want {
+			t.Errorf("%s stored as %q, want %q", name, got, want)
+		}
+	}
+	if !strings.Contains(logs.String(), "Transferred 2/2 files") {
+		t.Errorf("no summary in the log:\n%s", logs)
+	}
+}
+
+func TestMissingFileSkipped(t *testing.T) {
+	server := startFakeServer(t)
+	dir := t.TempDir()
+	a := writeFile(t, dir, "a.txt", []byte("a"))
+	c := writeFile(t, dir, "c.txt", []byte("c"))
+	client, err := runClient(t, "127.0.0.1", server.port(), a, filepath.Join(dir, "missing.txt"), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.file("c.txt"); !ok || server.skipped != 1 {
+		t.Fatalf("file after the missing one not sent, %d skipped", server.skipped)
+	}
+	if result := client.results[1]; result.Status != "skipped" || result.Error == "" {
+		t.Errorf("missing file recorded as %+v", result)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	server := startFakeServer(t)
+	content := bytes.Repeat([]byte("x"), 1000)
+	path := writeFile(t, t.TempDir(), "a.bin", content)
+	client := newTestClient(t, io.Discard, "-buffer", "300", "127.0.0.1", server.port(), path)
+	var reported []int64
+	client.progress = func(fileName string, bytesSent, totalBytes int64) {
+		if fileName != path || totalBytes != int64(len(content)) {
+			t.Errorf("progress reported for %s of %d bytes", fileName, totalBytes)
+		}
+		reported = append(reported, bytesSent)
+	}
+	if err := client.Run(); err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{300, 600, 900, 1000}
+	if fmt.Sprint(reported) != fmt.Sprint(want) {
+		t.Fatalf("progress reported %v, want %v", reported, want)
+	}
+}
+
+func TestParseIP(t *testing.T) {
+	for _, test := range []struct {
+		ip      string
+		network string
+		address string
+	}{
+		{"127.0.0.1", "tcp", "127.0.0.1:9000"},
+		{"::1", "tcp", "[::1]:9000"},
+		{"[::1]", "tcp", "[::1]:9000"},
+		{"localhost", "tcp", "localhost:9000"},
+		{"unix:/run/server.sock", "unix", "/run/server.sock"},
+	} {
+		client := &ClientFSM{ip: test.ip, port: "9000", parallel: 1}
+		client.ParseIPState()
+		if client.network != test.network || client.address != test.address {
+			t.Errorf("%s parsed as %s %s, want %s %s", test.ip, client.network, client.address, test.network, test.address)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	server := startFakeServer(t)
+	dir := t.TempDir()
+	a := writeFile(t, dir, "a.txt", []byte("a"))
+	b := writeFile(t, dir, "b.txt", []byte("b"))
+	logs := &logBuffer{}
+	if err := newTestClient(t, logs, "-dry-run", "127.0.0.1", server.port(), a, b).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if server.connections != 0 {
+		t.Fatalf("dry run made %d connections", server.connections)
+	}
+	for _, path := range []string{a, b} {
+		if !strings.Contains(logs.String(), `msg="file ok" name=` + path) {
+			t.Errorf("%s not reported:\n%s", path, logs)
+		}
+	}
+	err := newTestClient(t, io.Discard, "-dry-run", "127.0.0.1", server.port(), a, filepath.Join(dir, "missing.txt")).Run()
+	if err == nil {
+		t.Fatal("dry run passed with a missing file")
+	}
+}
+
+func TestExpandFileLists(t *testing.T) {
+	list := writeFile(t, t.TempDir(), "files.txt", []byte("# comment\na.txt\n\n  b.txt  \n"))
+	got, err := expandFileLists([]string{"first.txt", "@" + list})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"first.txt", "a.txt", "b.txt"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expandFileLists = %q, want %q", got, want)
+	}
+	if _, err := expandFileLists([]string{"@" + filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Fatal("missing list accepted")
+	}
+}
+
+func TestErrorAckReported(t *testing.T) {
+	server := startFakeServer(t)
+	server.ack = ackWriteFailed
+	path := writeFile(t, t.TempDir(), "a.txt", []byte("a"))
+	logs := &logBuffer{}
+	client := newTestClient(t, logs, "127.0.0.1", server.port(), path)
+	client.Run()
+	if result := client.results[0]; result.Status != "failed" || result.Error != ackReason(ackWriteFailed) {
+		t.Errorf("file recorded as %+v", result)
+	}
+	if !strings.Contains(logs.String(), "server did not store file") {
+		t.Errorf("failure not logged:\n%s", logs)
+	}
+}
+
+func TestRejectedFileContinuesBatch(t *testing.T) {
+	server := startFakeServer(t)
+	server.reject["a.exe"] = "extension .exe is not allowed"
+	dir := t.TempDir()
+	a := writeFile(t, dir, "a.exe", []byte("a"))
+	b := writeFile(t, dir, "b.txt", []byte("b"))
+	client, _ := runClient(t, "127.0.0.1", server.port(), a, b)
+	if result := client.results[0]; result.Status != "failed" || !strings.Contains(result.Error, "extension .exe is not allowed") {
+		t.Errorf("rejected file recorded as %+v", result)
+	}
+	if _, ok := server.file("b.txt"); !ok {
+		t.Error("file after the rejected one not sent")
+	}
+}
+
+func TestRetriesAfterDroppedConnection(t *testing.T) {
+	server := startFakeServer(t)
+	server.dropHeaders = 1
+	path := writeFile(t, t.TempDir(), "a.txt", []byte("eventually"))
+	if _, err := runClient(t, "-retry-delay", "10ms", "127.0.0.1", server.port(), path); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := server.file("a.txt"); string(got) != "eventually" || server.connections != 2 {
+		t.Fatalf("stored %q over %d connections", got, server.connections)
+	}
+}
+
+func TestNoRetriesWhenServerCloses(t *testing.T) {
+	server := startFakeServer(t)
+	server.filesPerConnection = 1
+	dir := t.TempDir()
+	a := writeFile(t, dir, "a.txt", []byte("a"))
+	b := writeFile(t, dir, "b.txt", []byte("b"))
+	if _, err := runClient(t, "-retries", "0", "127.0.0.1", server.port(), a, b); !errors.Is(err, errServerClosed) {
+		t.Fatalf("Run = %v, want %v", err, errServerClosed)
+	}
+	if server.received != 1 || server.connections != 1 {
+		t.Fatalf("%d files received over %d connections with -retries 0", server.received, server.connections)
+	}
+}
+
+func TestReconnectsWhenServerClosesBetweenFiles(t *testing.T) {
+	server := startFakeServer(t)
+	server.filesPerConnection = 1
+	dir := t.TempDir()
+	a := writeFile(t, dir, "a.txt", []byte("a"))
+	b := writeFile(t, dir, "b.txt", []byte("b"))
+	if _, err := runClient(t, "-retry-delay", "10ms", "127.0.0.1", server.port(), a, b); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.file("b.txt"); !ok || server.received != 2 {
+		t.Fatalf("%d files received", server.received)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	server := startFakeServer(t)
+	path := writeFile(t, t.TempDir(), "a.bin", make([]byte, 50000))
+	started := time.Now()
+	if _, err := runClient(t, "-rate", "100000", "127.0.0.1", server.port(), path); err != nil {
+		t.Fatal(err)
+	}
+	// the bucket starts empty, so 50000 bytes at 100000 per second take half a second
+	if elapsed := time.Since(started); elapsed < 400 * time.Millisecond || elapsed > 5 * time.Second {
+		t.Fatalf("sending 50000 bytes at 100000 per second took %v", elapsed)
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	server := startFakeServer(t)
+	path := writeFile(t, t.TempDir(), "a.txt", []byte("a"))
+	logs := &logBuffer{}
+	if err := newTestClient(t, logs, "-quiet", "127.0.0.1", server.port(), path).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if logs.String() != "" {
+		t.Fatalf("quiet client logged:\n%s", logs)
+	}
+	if _, err := runClient(t, "-quiet", "-verbose", "127.0.0.1", server.port(), path); err == nil {
+		t.Error("-quiet accepted together with -verbose")
+	}
+}
+
+func TestSmallBuffer(t *testing.T) {
+	server := startFakeServer(t)
+	content := []byte("a file much longer than the seven byte buffer it is sent through")
+	path := writeFile(t, t.TempDir(), "a file with a long name.txt", content)
+	if _, err := runClient(t, "-buffer", "7", "127.0.0.1", server.port(), path); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := server.file("a file with a long name.txt"); !ok || !bytes.Equal(got, content) {
+		t.Fatalf("server received %q, want %q", got, content)
+	}
+}
+
+func TestSymlinkPolicies(t *testing.T) {
+	dir := t.TempDir()
+	target := writeFile(t, dir, "target.txt", []byte("target"))
+	link := filepath.Join(dir, "link.txt")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	if _, err := runClient(t, "-symlinks", "maybe", "127.0.0.1", "9000", link); err == nil {
+		t.Error("unknown symlink policy accepted")
+	}
+	for _, test := range []struct {
+		policy string
+		status string
+	}{
+		{"follow", "sent"},
+		{"skip", "skipped"},
+		{"error", "skipped"},
+	} {
+		server := startFakeServer(t)
+		client, err := runClient(t, "-symlinks", test.policy, "127.0.0.1", server.port(), link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := client.results[0]
+		if result.Status != test.status || (test.policy == "error") != (result.Error != "") {
+			t.Errorf("-symlinks %s recorded %+v", test.policy, result)
+		}
+		if got, ok := server.file("link.txt"); ok != (test.policy == "follow") || (ok && string(got) != "target") {
+			t.Errorf("-symlinks %s stored %q", test.policy, got)
+		}
+	}
+}
+
+func TestSendsStdin(t *testing.T) {
+	server := startFakeServer(t)
+	content := []byte("piped content")
+	stdin, err := os.Open(writeFile(t, t.TempDir(), "input", content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	previous := os.Stdin
+	os.Stdin = stdin
+	t.Cleanup(func() { os.Stdin = previous })
+	if _, err := runClient(t, "-name", "piped.txt", "127.0.0.1", server.port(), "-"); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := server.file("piped.txt"); !ok || !bytes.Equal(got, content) {
+		t.Fatalf("server received %q, want %q", got, content)
+	}
+	if _, err := runClient(t, "127.0.0.1", server.port(), "-"); err == nil {
+		t.Fatal("standard input sent without -name")
+	}
+}
+
+func TestMaxTotal(t *testing.T) {
+	server := startFakeServer(t)
+	path := writeFile(t, t.TempDir(), "a.txt", make([]byte, 20))
+	if _, err := runClient(t, "-max-total", "10", "127.0.0.1", server.port(), path); err == nil {
+		t.Fatal("files over the limit sent")
+	}
+	if server.connections != 0 {
+		t.Fatal("client connected although the files were over the limit")
+	}
+}
+
+func TestMissingFileError(t *testing.T) {
+	server := startFakeServer(t)
+	client, err := runClient(t, "127.0.0.1", server.port(), filepath.Join(t.TempDir(), "missing.txt"))
+	if err != nil {
+		t.Fatalf("Run = %v, a missing file is only skipped", err)
+	}
+	// the wrapped error still tells callers why the file was skipped
+	if !errors.Is(client.err, os.ErrNotExist) {
+		t.Fatalf("error %v doesn't wrap %v", client.err, os.ErrNotExist)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	server := startFakeServer(t)
+	dir := t.TempDir()
+	var paths []string
+	for i := 0; i < 10; i++ {
+		paths = append(paths, writeFile(t, dir, fmt.Sprintf("%d.txt", i), []byte(fmt.Sprint(i))))
+	}
+	client, err := runClient(t, append([]string{"-parallel", "3", "127.0.0.1", server.port()}, paths...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.received != 10 || server.connections != 3 {
+		t.Fatalf("%d files received over %d connections", server.received, server.connections)
+	}
+	for i, result := range client.results {
+		if result.Name != paths[i] || result.Status != "sent" {
+			t.Errorf("result %d = %+v", i, result)
+		}
+	}
+	if _, err := runClient(t, "-parallel", "0", "127.0.0.1", server.port(), paths[0]); err == nil {
+		t.Error("-parallel 0 accepted")
+	}
+}
+
+func TestParallelSharesRateLimit(t *testing.T) {
+	server := startFakeServer(t)
+	dir := t.TempDir()
+	a := writeFile(t, dir, "a.txt", []byte("a"))
+	b := writeFile(t, dir, "b.txt", []byte("b"))
+	started := time.Now()
+	// a rate below the number of connections used to leave each of them without a limit
+	if _, err := runClient(t, "-parallel", "2", "-rate", "1", "127.0.0.1", server.port(), a, b); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed < 1500 * time.Millisecond {
+		t.Fatalf("2 bytes at 1 byte per second sent in %v", elapsed)
+	}
+}
+
+func TestRelativePaths(t *testing.T) {
+	server := startFakeServer(t)
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	writeFile(t, filepath.Join(dir, "sub"), "a.txt", []byte("a"))
+	t.Chdir(dir)
+	if _, err := runClient(t, "-relative", "127.0.0.1", server.port(), "sub/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := server.file("sub/a.txt"); !ok || string(got) != "a" {
+		t.Fatalf("sub/a.txt received as %q, %v", got, ok)
+	}
+	if _, err := runClient(t, "-relative", "127.0.0.1", server.port(), filepath.Join(dir, "sub", "a.txt")); err == nil {
+		t.Fatal("absolute path accepted with -relative")
+	}
+}
+
+func TestExpandGlobs(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "b.txt", nil)
+	writeFile(t, dir, "a.txt", nil)
+	writeFile(t, dir, "c.log", nil)
+	literal := writeFile(t, dir, "[1].txt", nil)
+	got, err := expandGlobs([]string{filepath.Join(dir, "*.txt"), literal, stdinFileName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "[1].txt"), filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt"), literal, stdinFileName}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expandGlobs = %q, want %q", got, want)
+	}
+	if _, err := expandGlobs([]string{filepath.Join(dir, "*.png")}); err == nil {
+		t.Fatal("pattern matching nothing accepted")
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	server := startFakeServer(t)
+	path := writeFile(t, t.TempDir(), "a.txt", []byte("original"))
+	if _, err := runClient(t, "-verify", "127.0.0.1", server.port(), path); err != nil {
+		t.Fatalf("verification of an intact file failed: %v", err)
+	}
+	server.tamper = true
+	if _, err := runClient(t, "-verify", "127.0.0.1", server.port(), path); err == nil {
+		t.Fatal("verification passed although the stored file differs")
+	}
+}
+
+func TestSkipUnchanged(t *testing.T) {
+	server := startFakeServer(t)
+	server.files["a.txt"] = []byte("same")
+	dir := t.TempDir()
+	a := writeFile(t, dir, "a.txt", []byte("same"))
+	b := writeFile(t, dir, "b.txt", []byte("new"))
+	if _, err := runClient(t, "-skip-unchanged", "127.0.0.1", server.port(), a, b); err != nil {
+		t.Fatal(err)
+	}
+	if server.received != 1 || server.skipped != 1 {
+		t.Fatalf("%d files received and %d skipped, want 1 of each", server.received, server.skipped)
+	}
+}
+
+func TestInterruptMidTransfer(t *testing.T) {
+	server := startFakeServer(t)
+	server.stallContent = true
+	path := writeFile(t, t.TempDir(), "a.bin", make([]byte, 1 << 20))
+	// with -chunk-ack the client waits on the server after its first chunk, in the middle of the file
+	client := newTestClient(t, io.Discard, "-chunk-ack", "-retries", "0", "127.0.0.1", server.port(), path)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Run()
+	}()
+	time.Sleep(200 * time.Millisecond)
+	client.sigChan <- os.Interrupt
+	select {
+	case err := <-done:
+		if !errors.Is(err, errInterrupted) {
+			t.Fatalf("Run = %v, want %v", err, errInterrupted)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("client didn't stop after SIGINT")
+	}
+	if err := client.file.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("file left open, closing it again gave %v", err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.received != 0 {
+		t.Errorf("server received %d files from an interrupted client", server.received)
+	}
+}
+
+func TestFormatting(t *testing.T) {
+	for _, test := range []struct {
+		got  string
+		want string
+	}{
+		{formatSize(512), "512 B"},
+		{formatSize(1536), "1.5 KB"},
+		{formatSize(3 * 1024 * 1024), "3.0 MB"},
+		{formatRate(2048, time.Second), "2.0 KB/s"},
+		{formatRate(2048, 2 * time.Second), "1.0 KB/s"},
+		{formatRate(1, 0), "-"},
+	} {
+		if test.got != test.want {
+			t.Errorf("got %q, want %q", test.got, test.want)
+		}
+	}
+}
+
+func TestReportedThroughput(t *testing.T) {
+	server := startFakeServer(t)
+	path := writeFile(t, t.TempDir(), "a.bin", make([]byte, 100 * 1024))
+	logs := &logBuffer{}
+	if err := newTestClient(t, logs, "-rate", "200000", "127.0.0.1", server.port(), path).Run(); err != nil {
+		t.Fatal(err)
+	}
+	match := regexp.MustCompile(`Transferred 1/1 files, .*\(([0-9.]+) KB/s\)`).FindStringSubmatch(logs.String())
+	if match == nil {
+		t.Fatalf("no throughput in the summary:\n%s", logs)
+	}
+	// the limit holds the rate just under 200000 bytes per second, about 195 KB/s
+	if rate, _ := strconv.ParseFloat(match[1], 64); rate < 150 || rate > 200 {
+		t.Fatalf("reported %.1f KB/s for 100 KB sent at 200000 bytes per second", rate)
+	}
+}
+
+func TestFileOwner(t *testing.T) {
+	info, err := os.Stat(writeFile(t, t.TempDir(), "a.txt", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, gid, ok := fileOwner(info)
+	if !ok || uid != os.Getuid() || gid != os.Getgid() {
+		t.Fatalf("fileOwner = %d, %d, %v, want %d, %d", uid, gid, ok, os.Getuid(), os.Getgid())
+	}
+}
+
+func TestStoreAs(t *testing.T) {
+	server := startFakeServer(t)
+	dir := t.TempDir()
+	a := writeFile(t, dir, "a.txt", []byte("a"))
+	if _, err := runClient(t, "-as", "renamed.txt", "127.0.0.1", server.port(), a); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := server.file("renamed.txt"); !ok || string(got) != "a" {
+		t.Fatalf("renamed.txt received as %q, %v", got, ok)
+	}
+	if _, ok := server.file("a.txt"); ok {
+		t.Error("file also stored under its own name")
+	}
+	b := writeFile(t, dir, "b.txt", []byte("b"))
+	if _, err := runClient(t, "-as", "renamed.txt", "127.0.0.1", server.port(), a, b); err == nil {
+		t.Error("-as accepted with two files")
+	}
+}
+
+func TestConnectionRefusedMessage(t *testing.T) {
+	listener, err := net.Listen(trans, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := fmt.Sprint(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+	path := writeFile(t, t.TempDir(), "a.txt", nil)
+	logs := &logBuffer{}
+	if err := newTestClient(t, logs, "127.0.0.1", port, path).Run(); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("Run = %v, want connection refused", err)
+	}
+	if !strings.Contains(logs.String(), "is the server running at 127.0.0.1:" + port) {
+		t.Fatalf("no hint in the log:\n%s", logs)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	server := startFakeServer(t)
+	server.stall = true
+	path := writeFile(t, t.TempDir(), "a.txt", nil)
+	started := time.Now()
+	if _, err := runClient(t, "-deadline", "200ms", "127.0.0.1", server.port(), path); !errors.Is(err, errDeadline) {
+		t.Fatalf("Run = %v, want %v", err, errDeadline)
+	}
+	if elapsed := time.Since(started); elapsed > 5 * time.Second {
+		t.Fatalf("client stopped %v after a 200ms deadline", elapsed)
+	}
+}
+
+func TestSkipEmpty(t *testing.T) {
+	server := startFakeServer(t)
+	dir := t.TempDir()
+	empty := writeFile(t, dir, "empty.txt", nil)
+	full := writeFile(t, dir, "full.txt", []byte("full"))
+	if _, err := runClient(t, "-skip-empty", "127.0.0.1", server.port(), empty, full); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.file("empty.txt"); ok || server.received != 1 || server.skipped != 1 {
+		t.Fatalf("%d files received and %d skipped", server.received, server.skipped)
+	}
+}
+
+func TestParseCutoff(t *testing.T) {
+	now := time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)
+	if got, err := parseCutoff("2024-05-01T00:00:00Z", now); err != nil || !got.Equal(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("parseCutoff of a time = %v, %v", got, err)
+	}
+	if got, err := parseCutoff("90m", now); err != nil || !got.Equal(now.Add(-90 * time.Minute)) {
+		t.Errorf("parseCutoff of a duration = %v, %v", got, err)
+	}
+	for _, value := range []string{"-1h", "yesterday", ""} {
+		if _, err := parseCutoff(value, now); err == nil {
+			t.Errorf("parseCutoff(%q) accepted", value)
+		}
+	}
+}
+
+func TestFilterNewer(t *testing.T) {
+	dir := t.TempDir()
+	old := writeFile(t, dir, "old.txt", nil)
+	recent := writeFile(t, dir, "new.txt", nil)
+	cutoff := time.Now().Add(-time.Hour)
+	os.Chtimes(old, cutoff.Add(-time.Hour), cutoff.Add(-time.Hour))
+	missing := filepath.Join(dir, "missing.txt")
+	files, names := filterNewer([]string{old, recent, missing, stdinFileName}, []string{"old", "new", "missing", "stdin"}, cutoff)
+	if fmt.Sprint(names) != "[new missing stdin]" || len(files) != 3 || files[0] != recent {
+		t.Fatalf("filterNewer kept %q as %q", files, names)
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	server := startFakeServer(t)
+	dir := t.TempDir()
+	a := writeFile(t, dir, "a.txt", []byte("abc"))
+	missing := filepath.Join(dir, "missing.txt")
+	output := captureStdout(t, func() {
+		runClient(t, "-json", "127.0.0.1", server.port(), a, missing)
+	})
+	var results []FileResult
+	if err := json.Unmarshal([]byte(output), &results); err != nil {
+		t.Fatalf("invalid JSON %q: %v", output, err)
+	}
+	if len(results) != 2 || results[0] != (FileResult{Name: a, Bytes: 3, Status: "sent"}) ||
+		results[1].Status != "skipped" || results[1].Error == "" {
+		t.Fatalf("results %+v", results)
+	}
+}
+
+func TestOpenWithRetry(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "a.txt", nil)
+	calls := 0
+	busyTwice := func(name string) (*os.File, error) {
+		calls++
+		if calls <= 2 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EBUSY}
+		}
+		return os.Open(name)
+	}
+	file, err := openWithRetry(busyTwice, path, 3, time.Millisecond)
+	if err != nil || calls != 3 {
+		t.Fatalf("openWithRetry = %v after %d calls", err, calls)
+	}
+	file.Close()
+
+	calls = 0
+	missing := func(name string) (*os.File, error) {
+		calls++
+		return os.Open(name + ".missing")
+	}
+	if _, err := openWithRetry(missing, path, 3, time.Millisecond); !errors.Is(err, os.ErrNotExist) || calls != 1 {
+		t.Fatalf("missing file opened %d times, %v", calls, err)
+	}
+}
+
+func TestContentKey(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	file, err := os.Open(writeFile(t, t.TempDir(), "a.bin", content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.Seek(123, io.SeekStart)
+	key, err := contentKey(file)
+	if err != nil || key != crc32.ChecksumIEEE(content) {
+		t.Fatalf("contentKey = %08x, %v, want %08x", key, err, crc32.ChecksumIEEE(content))
+	}
+	if position, _ := file.Seek(0, io.SeekCurrent); position != 0 {
+		t.Fatalf("file left at %d", position)
+	}
+}
+
+func TestSortFiles(t *testing.T) {
+	dir := t.TempDir()
+	big := writeFile(t, dir, "b.txt", make([]byte, 30))
+	small := writeFile(t, dir, "c.txt", make([]byte, 10))
+	medium := writeFile(t, dir, "a.txt", make([]byte, 20))
+	missing := filepath.Join(dir, "missing.txt")
+	for _, test := range []struct {
+		order SortOrder
+		want  []string
+	}{
+		{SortNone, []string{big, missing, small, medium}},
+		{SortName, []string{medium, big, small, missing}},
+		{SortSize, []string{small, medium, big, missing}},
+	} {
+		files := []string{big, missing, small, medium}
+		names := []string{"b", "missing", "c", "a"}
+		sortFiles(files, names, test.order)
+		if fmt.Sprint(files) != fmt.Sprint(test.want) {
+			t.Errorf("sorted by %s = %q, want %q", test.order, files, test.want)
+		}
+		for i := range files {
+			if filepath.Base(files[i])[:1] != names[i][:1] {
+				t.Errorf("sorted by %s, %s stored as %s", test.order, files[i], names[i])
+			}
+		}
+	}
+}
+
+func TestSendSparse(t *testing.T) {
+	if !isZero(make([]byte, 10)) || isZero([]byte{0, 0, 1}) || !isZero(nil) {
+		t.Fatal("isZero misjudged its input")
+	}
+	content := make([]byte, 40)
+	copy(content[25:], "data")
+	var stream bytes.Buffer
+	writer := bufio.NewWriter(&stream)
+	sent, err := sendSparse(writer, bytes.NewReader(content), int64(len(content)), 10, func(int64) {})
+	if err != nil || sent != int64(len(content)) {
+		t.Fatalf("sendSparse = %d, %v", sent, err)
+	}
+	reader := bufio.NewReader(&stream)
+	var lengths []int32
+	for {
+		length, err := receiveInt(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lengths = append(lengths, int32(length))
+		if length == 0 {
+			break
+		}
+		if int32(length) > 0 {
+			reader.Discard(length)
+		}
+	}
+	if want := []int32{-10, -10, 10, -10, 0}; fmt.Sprint(lengths) != fmt.Sprint(want) {
+		t.Fatalf("chunks %v, want %v", lengths, want)
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	first, err := idempotencyKeys(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := idempotencyKeys(3)
+	seen := make(map[string]bool)
+	for _, key := range append(first, second...) {
+		if seen[key] {
+			t.Fatalf("key %s handed out twice", key)
+		}
+		seen[key] = true
+	}
+}
+
+func TestManifestOnly(t *testing.T) {
+	dir := t.TempDir()
+	a := writeFile(t, dir, "a.txt", []byte("abc"))
+	var err error
+	output := captureStdout(t, func() {
+		// nothing listens on port 1, so the test fails if the client connects
+		_, err = runClient(t, "-manifest-only", "127.0.0.1", "1", a)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry ManifestEntry
+	if err := json.Unmarshal([]byte(output), &entry); err != nil {
+		t.Fatalf("invalid manifest line %q: %v", output, err)
+	}
+	if entry != (ManifestEntry{Name: "a.txt", Size: 3, Checksum: crc32.ChecksumIEEE([]byte("abc"))}) {
+		t.Fatalf("manifest entry %+v", entry)
+	}
+}
+
+func TestResume(t *testing.T) {
+	content := []byte("0123456789abcdef")
+	for _, test := range []struct {
+		partial string
+		from    int64
+	}{
+		{"01234567", 8},
+		{"XXXXXXXX", 0},
+	} {
+		server := startFakeServer(t)
+		server.partials["a.txt"] = []byte(test.partial)
+		path := writeFile(t, t.TempDir(), "a.txt", content)
+		if _, err := runClient(t, "127.0.0.1", server.port(), path); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := server.file("a.txt")
+		if !bytes.Equal(got, content) || server.resumedFrom["a.txt"] != test.from {
+			t.Errorf("partial %q: stored %q resumed from %d, want %d", test.partial, got, server.resumedFrom["a.txt"], test.from)
+		}
+	}
+}
+
+// sendEncoded sends content with the provided flags and fails the test unless the server stores it intact
+// It returns the server, to check how the content arrived
+func sendEncoded(t *testing.T, content []byte, flags ...string) *fakeServer {
+	t.Helper()
+	server := startFakeServer(t)
+	path := writeFile(t, t.TempDir(), "a.bin", content)
+	if _, err := runClient(t, append(flags, "127.0.0.1", server.port(), path)...); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := server.file("a.bin"); !bytes.Equal(got, content) {
+		t.Fatalf("%v: stored file differs from the file sent", flags)
+	}
+	return server
+}
+
+func TestCompressedContent(t *testing.T) {
+	sendEncoded(t, bytes.Repeat([]byte("compressible "), 1000), "-compress")
+}
+
+func TestChunkAckContent(t *testing.T) {
+	server := sendEncoded(t, bytes.Repeat([]byte("0123456789"), 1000), "-chunk-ack", "-buffer", "1000")
+	if server.chunkAcks != 10 {
+		t.Errorf("%d chunks acknowledged, want 10", server.chunkAcks)
+	}
+	if _, err := runClient(t, "-compress", "-chunk-ack", "127.0.0.1", server.port(), "a.txt"); err == nil {
+		t.Error("-chunk-ack accepted together with -compress")
+	}
+}
+
+func TestSparseContent(t *testing.T) {
+	content := make([]byte, 10000)
+	copy(content[5000:], "data")
+	sendEncoded(t, content, "-sparse", "-buffer", "1000")
+}
@@ -0,0 +1,1934 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// quietLogger discards everything it is given
+func quietLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// logBuffer collects log output from several goroutines
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(data)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitForLog waits until the log holds text, failing the test if it doesn't within a few seconds
+func waitForLog(t *testing.T, logs *logBuffer, text string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), text) {
+		if time.Now().After(deadline) {
+			t.Fatalf("log never contained %q:\n%s", text, logs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startServer runs a server with the provided config on a free loopback port until the test ends
+// StorageDir defaults to a temporary directory and Logger to one discarding everything
+func startServer(t *testing.T, config Config) *ServerFSM {
+	t.Helper()
+	if config.IP == "" {
+		config.IP = "127.0.0.1"
+		config.Port = "0"
+	}
+	if config.StorageDir == "" {
+		config.StorageDir = t.TempDir()
+	}
+	if config.Logger == nil {
+		config.Logger = quietLogger()
+	}
+	server := NewServerFSMWithConfig(config)
+	errs := make(chan error, 1)
+	finished := make(chan struct{})
+	go func() {
+		errs <- server.Run()
+		close(finished)
+	}()
+	t.Cleanup(func() {
+		server.Close()
+		<-finished
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Addr() == nil {
+		select {
+		case <-finished:
+			t.Fatalf("server stopped before listening: %v", <-errs)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start listening")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return server
+}
+
+// testClient speaks the client's side of the protocol to a server under test
+type testClient struct {
+	t      *testing.T
+	con    net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// connect opens a connection to the server without sending anything
+func connect(t *testing.T, server *ServerFSM) *testClient {
+	t.Helper()
+	con, err := net.DialTimeout(server.Addr().Network(), server.Addr().String(), 5 * time.Second)
+	if err != nil {
+		t.Fatalf("connect to server: %v", err)
+	}
+	t.Cleanup(func() { con.Close() })
+	con.SetDeadline(time.Now().Add(10 * time.Second))
+	return &testClient{t: t, con: con, reader: bufio.NewReader(con), writer: bufio.NewWriter(con)}
+}
+
+// dialServer connects to the server and completes the handshake, asking for the default destination
+func dialServer(t *testing.T, server *ServerFSM) *testClient {
+	t.Helper()
+	client := connect(t, server)
+	client.handshake()
+	if reply := client.destination(""); reply != destinationOK {
+		t.Fatalf("server refused the default destination with %d", reply)
+	}
+	return client
+}
+
+// handshake sends the magic and the current protocol version and fails the test unless the server accepts it
+func (c *testClient) handshake() {
+	c.t.Helper()
+	if reply := c.sendHandshake(protocolMagic, protocolVersion); reply != handshakeOK {
+		c.t.Fatalf("server rejected the handshake with %d", reply)
+	}
+}
+
+// sendHandshake sends the provided magic and version and returns the server's reply
+func (c *testClient) sendHandshake(magic string, version byte) byte {
+	c.t.Helper()
+	c.writer.WriteString(magic)
+	c.writer.WriteByte(version)
+	if err := c.writer.Flush(); err != nil {
+		c.t.Fatalf("send handshake: %v", err)
+	}
+	reply, err := c.reader.ReadByte()
+	if err != nil {
+		c.t.Fatalf("receive handshake reply: %v", err)
+	}
+	return reply
+}
+
+// destination asks for the provided destination and returns the server's reply
+func (c *testClient) destination(destination string) byte {
+	c.t.Helper()
+	if err := sendBytes(c.writer, []byte(destination)); err != nil {
+		c.t.Fatalf("send destination: %v", err)
+	}
+	reply, err := c.reader.ReadByte()
+	if err != nil {
+		c.t.Fatalf("receive destination reply: %v", err)
+	}
+	return reply
+}
+
+// sendCount announces how many files follow
+func (c *testClient) sendCount(count int) {
+	c.t.Helper()
+	if err := sendInt(c.writer, count); err != nil {
+		c.t.Fatalf("send file count: %v", err)
+	}
+}
+
+// sendMarker sends one of the request markers in place of a file count
+func (c *testClient) sendMarker(marker uint32) {
+	c.t.Helper()
+	c.writer.Write(binary.BigEndian.AppendUint32(nil, marker))
+	if err := c.writer.Flush(); err != nil {
+		c.t.Fatalf("send request marker: %v", err)
+	}
+}
+
+// closed reports whether the server closed the connection, waiting up to timeout for it
+func (c *testClient) closed(timeout time.Duration) bool {
+	c.con.SetReadDeadline(time.Now().Add(timeout))
+	defer c.con.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.reader.ReadByte()
+	return err != nil && !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// testFile is a file testClient sends, zero values send a plain 0644 file modified now
+type testFile struct {
+	name    string
+	content []byte
+	mode    int
+	modTime time.Time
+	// flags are the content flags, chunkSize goes with contentChunkAck and sets the chunks of contentSparse
+	flags     byte
+	chunkSize int
+	// keyed resumes the file by its content, key is its idempotency key
+	keyed bool
+	key   string
+	// corrupt sends a checksum that doesn't match the content
+	corrupt bool
+	// stopAfter ends the content after this many bytes without finishing the file, 0 sends all of it
+	stopAfter int
+	// size is announced in the header instead of the content's length when it isn't 0
+	size int64
+}
+
+// sendResult is what the server answered to a file
+type sendResult struct {
+	offset    int64
+	ack       byte
+	reason    string
+	chunkAcks int
+}
+
+// send sends the file and returns the server's answers
+// It returns an error as soon as the server stops answering, such as when it drops the connection
+func (c *testClient) send(file testFile) (sendResult, error) {
+	var result sendResult
+	mode := file.mode
+	if mode == 0 {
+		mode = 0644
+	}
+	modTime := file.modTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	err := sendInt(c.writer, filePresent)
+	if err == nil {
+		err = sendBytes(c.writer, []byte(file.name))
+	}
+	if err == nil {
+		err = sendInt(c.writer, mode)
+	}
+	if err == nil {
+		err = sendInt64(c.writer, modTime.UnixNano())
+	}
+	size := int64(len(file.content))
+	if file.size != 0 {
+		size = file.size
+	}
+	if err == nil {
+		err = sendInt64(c.writer, size)
+	}
+	if err == nil {
+		err = sendInt(c.writer, -1)
+	}
+	if err == nil {
+		err = sendInt(c.writer, -1)
+	}
+	if err == nil && file.keyed {
+		c.writer.WriteByte(1)
+		err = sendInt(c.writer, int(crc32.ChecksumIEEE(file.content)))
+	} else if err == nil {
+		err = c.writer.WriteByte(0)
+	}
+	if err == nil {
+		err = sendBytes(c.writer, []byte(file.key))
+	}
+	if err != nil {
+		return result, fmt.Errorf("send header: %w", err)
+	}
+
+	result.offset, err = receiveInt64(c.reader)
+	if err != nil {
+		return result, fmt.Errorf("receive offset: %w", err)
+	}
+	if result.offset == alreadyStored || result.offset == fileRejected {
+		return result, c.receiveAck(&result)
+	}
+	if result.offset > 0 {
+		prefix, err := receiveInt(c.reader)
+		if err != nil {
+			return result, fmt.Errorf("receive checksum of the partial file: %w", err)
+		}
+		if uint32(prefix) != crc32.ChecksumIEEE(file.content[:result.offset]) {
+			result.offset = resumeRestart
+		}
+		err = sendInt64(c.writer, result.offset)
+		if err != nil {
+			return result, fmt.Errorf("send resume offset: %w", err)
+		}
+	}
+
+	content := file.content[result.offset:]
+	err = c.writer.WriteByte(file.flags)
+	if err == nil && file.flags & contentChunkAck != 0 {
+		err = sendInt(c.writer, file.chunkSize)
+	}
+	if err == nil {
+		err = c.writer.Flush()
+	}
+	if err == nil {
+		switch {
+		case file.flags & contentCompressed != 0:
+			err = c.sendCompressed(content)
+		case file.flags & contentSparse != 0:
+			err = c.sendSparse(content, file.chunkSize)
+		default:
+			result.chunkAcks, err = c.sendStream(content, file.chunkSize, file.flags & contentChunkAck != 0, file.stopAfter)
+		}
+	}
+	if err != nil {
+		return result, fmt.Errorf("send content: %w", err)
+	}
+	if file.stopAfter > 0 {
+		return result, nil
+	}
+	checksum := crc32.ChecksumIEEE(content)
+	if file.corrupt {
+		checksum++
+	}
+	err = sendInt(c.writer, int(checksum))
+	if err != nil {
+		return result, fmt.Errorf("send checksum: %w", err)
+	}
+	return result, c.receiveAck(&result)
+}
+
+// sendStream sends content prefixed with its length, in chunks of chunkSize when acks are asked for,
+// and stops after stopAfter bytes when it isn't 0
+func (c *testClient) sendStream(content []byte, chunkSize int, acks bool, stopAfter int) (int, error) {
+	err := sendInt64(c.writer, int64(len(content)))
+	if err != nil {
+		return 0, err
+	}
+	if stopAfter > 0 {
+		content = content[:stopAfter]
+	}
+	if chunkSize == 0 {
+		chunkSize = max(len(content), 1)
+	}
+	received := 0
+	for start := 0; start < len(content); start += chunkSize {
+		_, err = c.writer.Write(content[start:min(start + chunkSize, len(content))])
+		if err == nil {
+			err = c.writer.Flush()
+		}
+		if err == nil && acks {
+			var ack byte
+			ack, err = c.reader.ReadByte()
+			if err == nil && ack != chunkReceived {
+				err = fmt.Errorf("unexpected chunk acknowledgement %d", ack)
+			}
+			received++
+		}
+		if err != nil {
+			return received, err
+		}
+	}
+	return received, nil
+}
+
+// sendCompressed gzips content and sends it as a single chunk followed by the empty one ending it
+func (c *testClient) sendCompressed(content []byte) error {
+	var compressed bytes.Buffer
+	compressor := gzip.NewWriter(&compressed)
+	compressor.Write(content)
+	compressor.Close()
+	err := sendBytes(c.writer, compressed.Bytes())
+	if err == nil {
+		err = sendInt(c.writer, 0)
+	}
+	return err
+}
+
+// sendSparse sends content in chunks of chunkSize, those holding only zeros as holes
+func (c *testClient) sendSparse(content []byte, chunkSize int) error {
+	for start := 0; start < len(content); start += chunkSize {
+		chunk := content[start:min(start + chunkSize, len(content))]
+		var err error
+		if bytes.Count(chunk, []byte{0}) == len(chunk) {
+			err = sendInt(c.writer, -len(chunk))
+		} else {
+			err = sendBytes(c.writer, chunk)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return sendInt(c.writer, 0)
+}
+
+// receiveAck reads the acknowledgement of a file, and the reason that comes with ackRejected
+func (c *testClient) receiveAck(result *sendResult) error {
+	var err error
+	result.ack, err = c.reader.ReadByte()
+	if err != nil {
+		return fmt.Errorf("receive acknowledgement: %w", err)
+	}
+	if result.ack == ackRejected {
+		reason, err := receiveBytes(c.reader, maxReasonLength)
+		if err != nil {
+			return fmt.Errorf("receive rejection reason: %w", err)
+		}
+		result.reason = string(reason)
+	}
+	return nil
+}
+
+// sendFiles announces the files and sends them, failing the test unless the server acknowledges each of them
+// It returns the acknowledgements in order
+func (c *testClient) sendFiles(files ...testFile) []byte {
+	c.t.Helper()
+	c.sendCount(len(files))
+	var acks []byte
+	for _, file := range files {
+		result, err := c.send(file)
+		if err != nil {
+			c.t.Fatalf("send %q: %v", file.name, err)
+		}
+		acks = append(acks, result.ack)
+	}
+	return acks
+}
+
+// readFile returns the content of the file at path, failing the test if it can't be read
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return content
+}
+
+// randomContent returns size bytes that don't compress or repeat
+func randomContent(t *testing.T, size int) []byte {
+	t.Helper()
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// manifestEntries returns the entries in the manifest at path
+func manifestEntries(t *testing.T, path string) []ManifestEntry {
+	t.Helper()
+	var entries []ManifestEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(readFile(t, path))), "\n") {
+		var entry ManifestEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid manifest line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// oneByteReader hands out at most one byte per read
+type oneByteReader struct {
+	reader io.Reader
+}
+
+func (r oneByteReader) Read(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	return r.reader.Read(data[:1])
+}
+
+func TestReceiveIntOneByteAtATime(t *testing.T) {
+	reader := bufio.NewReaderSize(oneByteReader{bytes.NewReader([]byte{0, 1, 2, 3})}, 16)
+	got, err := receiveInt(reader)
+	if err != nil || got != 0x010203 {
+		t.Fatalf("receiveInt = %d, %v, want %d", got, err, 0x010203)
+	}
+}
+
+func TestReceiveBytesSplitPrefix(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+	go func() {
+		// the prefix arrives in two writes, as it can over a real network
+		clientSide.Write([]byte{0, 0})
+		time.Sleep(10 * time.Millisecond)
+		clientSide.Write([]byte{0, 5})
+		clientSide.Write([]byte("hello"))
+	}()
+	got, err := receiveBytes(bufio.NewReader(serverSide), 16)
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("receiveBytes = %q, %v, want %q", got, err, "hello")
+	}
+}
+
+func TestReceiveBytesOversizedPrefix(t *testing.T) {
+	// a huge length with nothing behind it must fail on the length alone, not try to allocate or read it
+	reader := bufio.NewReader(bytes.NewReader([]byte{0x7f, 0xff, 0xff, 0xff}))
+	_, err := receiveBytes(reader, maxFileNameLength)
+	if err == nil {
+		t.Fatal("receiveBytes accepted a length over the limit")
+	}
+}
+
+func TestReceiveBytesShortStream(t *testing.T) {
+	reader := bufio.NewReader(bytes.NewReader([]byte{0, 0, 0, 10, 'a', 'b'}))
+	_, err := receiveBytes(reader, 64)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("receiveBytes error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestTransferLargerThanBuffer(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir, BufferSize: 1024})
+	content := randomContent(t, 10 * 1024 + 3)
+	client := dialServer(t, server)
+	if acks := client.sendFiles(testFile{name: "big.bin", content: content}); acks[0] != ackOK {
+		t.Fatalf("acknowledgement %d, want %d", acks[0], ackOK)
+	}
+	if got := readFile(t, filepath.Join(dir, "big.bin")); !bytes.Equal(got, content) {
+		t.Fatal("stored file differs from the file sent")
+	}
+}
+
+func TestStreamLengthAboveUint32(t *testing.T) {
+	// a 32 bit prefix would wrap this to a few bytes, so the limit check proves all 64 bits arrived
+	var stream bytes.Buffer
+	writer := bufio.NewWriter(&stream)
+	sendInt64(writer, math.MaxUint32 + 1)
+	_, err := receiveStream(context.Background(), bufio.NewReader(&stream), io.Discard, math.MaxUint32, 1024, nil)
+	if err == nil || !strings.Contains(err.Error(), "size limit") {
+		t.Fatalf("receiveStream error = %v, want the size limit", err)
+	}
+}
+
+func TestChecksumMismatchRejected(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir})
+	client := dialServer(t, server)
+	acks := client.sendFiles(testFile{name: "a.txt", content: []byte("flipped in transit"), corrupt: true})
+	if acks[0] != ackChecksumMismatch {
+		t.Fatalf("acknowledgement %d, want %d", acks[0], ackChecksumMismatch)
+	}
+	// neither the file nor its partial file may be left behind
+	for _, name := range []string{"a.txt", ".a.txt.part"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s exists after a checksum mismatch", name)
+		}
+	}
+}
+
+func TestResolveStoragePath(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"../escape.txt", "a/../../escape.txt", "/etc/passwd", "nul\x00byte", ".", ".."} {
+		if path, err := resolveStoragePath(dir, name); err == nil {
+			t.Errorf("resolveStoragePath(%q) = %s, want an error", name, path)
+		}
+	}
+	path, err := resolveStoragePath(dir, "a/b.txt")
+	if err != nil || path != filepath.Join(dir, "a", "b.txt") {
+		t.Errorf("resolveStoragePath(%q) = %s, %v", "a/b.txt", path, err)
+	}
+}
+
+func TestValidateFileName(t *testing.T) {
+	valid := []string{"a.txt", "dir/a.txt", ".hidden"}
+	invalid := []string{"", "a//b", "/a", "a\\b", "tab\tname"}
+	for _, name := range valid {
+		if err := validateFileName(name); err != nil {
+			t.Errorf("validateFileName(%q) = %v, want nil", name, err)
+		}
+	}
+	for _, name := range invalid {
+		if validateFileName(name) == nil {
+			t.Errorf("validateFileName(%q) accepted the name", name)
+		}
+	}
+}
+
+func TestCreatesNestedStorageDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "one", "two")
+	server := startServer(t, Config{StorageDir: dir})
+	if server.Addr() == nil {
+		t.Fatal("server is not listening")
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Fatalf("storage directory not created: %v", err)
+	}
+}
+
+func TestPreservesModTime(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir})
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	client := dialServer(t, server)
+	client.sendFiles(testFile{name: "old.txt", content: []byte("old"), modTime: modTime})
+	info, err := os.Stat(filepath.Join(dir, "old.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := info.ModTime().Sub(modTime).Abs(); diff > time.Second {
+		t.Errorf("modification time %v, want %v", info.ModTime(), modTime)
+	}
+}
+
+func TestPreservesMode(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir})
+	client := dialServer(t, server)
+	client.sendFiles(testFile{name: "run.sh", content: []byte("#!/bin/sh\n"), mode: 0700})
+	info, err := os.Stat(filepath.Join(dir, "run.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("mode %v, want %v", info.Mode().Perm(), os.FileMode(0700))
+	}
+}
+
+func TestCloseWaitsForTransfer(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir})
+	content := randomContent(t, 4096)
+	client := dialServer(t, server)
+	client.sendCount(1)
+	done := make(chan error, 1)
+	started := make(chan struct{})
+	go func() {
+		// the first half goes out before the server is stopped, the rest after
+		writer := &pausingWriter{writer: client.writer, pauseAfter: 2048 + 4, paused: started, resume: 100 * time.Millisecond}
+		client.writer = bufio.NewWriter(writer)
+		result, err := client.send(testFile{name: "a.bin", content: content})
+		if err == nil && result.ack != ackOK {
+			err = fmt.Errorf("acknowledgement %d", result.ack)
+		}
+		done <- err
+	}()
+	<-started
+	server.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("transfer interrupted by shutdown: %v", err)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.bin")); !bytes.Equal(got, content) {
+		t.Fatal("stored file differs from the file sent")
+	}
+}
+
+// pausingWriter stops for a while once pauseAfter bytes of content went through, closing paused
+type pausingWriter struct {
+	writer     *bufio.Writer
+	pauseAfter int
+	paused     chan struct{}
+	resume     time.Duration
+	written    int
+	content    bool
+}
+
+func (w *pausingWriter) Write(data []byte) (int, error) {
+	// only count once the content flags byte went out, so the header doesn't count
+	if !w.content && len(data) == 1 && w.written == 0 {
+		w.content = true
+		n, err := w.writer.Write(data)
+		if err == nil {
+			err = w.writer.Flush()
+		}
+		return n, err
+	}
+	if w.content && w.written < w.pauseAfter && w.written + len(data) >= w.pauseAfter {
+		split := w.pauseAfter - w.written
+		w.writer.Write(data[:split])
+		if err := w.writer.Flush(); err != nil {
+			return 0, err
+		}
+		close(w.paused)
+		time.Sleep(w.resume)
+		w.written += split
+		n, err := w.writer.Write(data[split:])
+		if err == nil {
+			err = w.writer.Flush()
+		}
+		return split + n, err
+	}
+	if w.content {
+		w.written += len(data)
+	}
+	n, err := w.writer.Write(data)
+	if err == nil {
+		err = w.writer.Flush()
+	}
+	return n, err
+}
+
+// selfSignedCertificate returns a certificate for 127.0.0.1 signed by its own key
+func selfSignedCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "test"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestTLSTransfer(t *testing.T) {
+	dir := t.TempDir()
+	cert, pool := selfSignedCertificate(t)
+	server := startServer(t, Config{StorageDir: dir, TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}})
+	con, err := tls.Dial(trans, server.Addr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatalf("TLS connect: %v", err)
+	}
+	defer con.Close()
+	con.SetDeadline(time.Now().Add(10 * time.Second))
+	client := &testClient{t: t, con: con, reader: bufio.NewReader(con), writer: bufio.NewWriter(con)}
+	client.handshake()
+	client.destination("")
+	client.sendFiles(testFile{name: "secret.txt", content: []byte("over TLS")})
+	if got := readFile(t, filepath.Join(dir, "secret.txt")); string(got) != "over TLS" {
+		t.Fatalf("stored %q", got)
+	}
+}
+
+func TestNestedNames(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir})
+	client := dialServer(t, server)
+	client.sendFiles(
+		testFile{name: "dir/file.txt", content: []byte("one")},
+		testFile{name: "a/b/c.txt", content: []byte("two")},
+	)
+	if got := readFile(t, filepath.Join(dir, "dir", "file.txt")); string(got) != "one" {
+		t.Errorf("dir/file.txt holds %q", got)
+	}
+	if got := readFile(t, filepath.Join(dir, "a", "b", "c.txt")); string(got) != "two" {
+		t.Errorf("a/b/c.txt holds %q", got)
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	server := startServer(t, Config{MaxClients: 1})
+	first := dialServer(t, server)
+	second := connect(t, server)
+	second.writer.WriteString(protocolMagic)
+	second.writer.WriteByte(protocolVersion)
+	second.writer.Flush()
+	second.con.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := second.reader.ReadByte(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("second client was handled while the first was connected: %v", err)
+	}
+	first.con.Close()
+	second.con.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if reply, err := second.reader.ReadByte(); err != nil || reply != handshakeOK {
+		t.Fatalf("second client not handled once the first left: %d, %v", reply, err)
+	}
+}
+
+func TestResumeSendsOnlyTail(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("abcdefghijklmnop")
+	os.WriteFile(filepath.Join(dir, ".a.txt.part"), content[:8], 0600)
+	server := startServer(t, Config{StorageDir: dir})
+	client := dialServer(t, server)
+	client.sendCount(1)
+	result, err := client.send(testFile{name: "a.txt", content: content})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.offset != 8 || result.ack != ackOK {
+		t.Fatalf("resumed from %d with acknowledgement %d, want 8 and %d", result.offset, result.ack, ackOK)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.txt")); !bytes.Equal(got, content) {
+		t.Fatalf("stored %q, want %q", got, content)
+	}
+}
+
+func TestResumeDiscardsStalePartial(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, ".a.txt.part"), []byte("XXXXXXXX"), 0600)
+	server := startServer(t, Config{StorageDir: dir})
+	client := dialServer(t, server)
+	content := []byte("abcdefghijklmnop")
+	client.sendCount(1)
+	result, err := client.send(testFile{name: "a.txt", content: content})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.offset != 0 || result.ack != ackOK {
+		t.Fatalf("resumed from %d with acknowledgement %d, want a restart and %d", result.offset, result.ack, ackOK)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.txt")); !bytes.Equal(got, content) {
+		t.Fatalf("stored %q, want %q", got, content)
+	}
+}
+
+func TestResumeDiscardsPreallocatedPartial(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("0123456789abcdef")
+	// a crash with Preallocate leaves the partial file at its full size, the end never written
+	partial := append([]byte("01234567"), make([]byte, 8)...)
+	os.WriteFile(filepath.Join(dir, ".b.txt.part"), partial, 0600)
+	server := startServer(t, Config{StorageDir: dir, Preallocate: true})
+	client := dialServer(t, server)
+	client.sendFiles(testFile{name: "b.txt", content: content})
+	if got := readFile(t, filepath.Join(dir, "b.txt")); !bytes.Equal(got, content) {
+		t.Fatalf("stored %q, want %q", got, content)
+	}
+}
+
+func TestPreallocateLargeFile(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir, Preallocate: true, BufferSize: 64 * 1024})
+	content := randomContent(t, 3 * 1024 * 1024 + 17)
+	client := dialServer(t, server)
+	client.sendFiles(testFile{name: "large.bin", content: content})
+	if got := readFile(t, filepath.Join(dir, "large.bin")); !bytes.Equal(got, content) {
+		t.Fatal("stored file differs from the file sent")
+	}
+}
+
+func TestPartialLocks(t *testing.T) {
+	locks := NewPartialLocks()
+	unlock, err := locks.Lock(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// other paths aren't held up
+	unlockOther, err := locks.Lock(context.Background(), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockOther()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	if _, err := locks.Lock(ctx, "a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("second lock of a held path = %v, want it to wait until cancelled", err)
+	}
+
+	acquired := make(chan func())
+	go func() {
+		unlock, _ := locks.Lock(context.Background(), "a")
+		acquired <- unlock
+	}()
+	unlock()
+	select {
+	case unlock := <-acquired:
+		unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting lock not acquired after the release")
+	}
+}
+
+func TestConcurrentSameName(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir, Collision: CollisionOverwrite})
+	contents := [][]byte{bytes.Repeat([]byte("a"), 64 * 1024), bytes.Repeat([]byte("b"), 64 * 1024)}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(contents))
+	for _, content := range contents {
+		client := dialServer(t, server)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.sendCount(1)
+			result, err := client.send(testFile{name: "same.txt", content: content})
+			if err == nil && result.ack != ackOK {
+				err = fmt.Errorf("acknowledgement %d", result.ack)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// one client's content won, not a mix of both
+	got := readFile(t, filepath.Join(dir, "same.txt"))
+	if !bytes.Equal(got, contents[0]) && !bytes.Equal(got, contents[1]) {
+		t.Fatalf("stored file mixes both clients' content, %d bytes", len(got))
+	}
+}
+
+func TestCompressedTransfer(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir})
+	content := bytes.Repeat([]byte("compress me "), 10000)
+	client := dialServer(t, server)
+	client.sendFiles(testFile{name: "text.txt", content: content, flags: contentCompressed})
+	if got := readFile(t, filepath.Join(dir, "text.txt")); !bytes.Equal(got, content) {
+		t.Fatal("stored file differs from the file sent")
+	}
+}
+
+func TestListensOnPortZero(t *testing.T) {
+	server := startServer(t, Config{IP: "127.0.0.1", Port: "0"})
+	addr, ok := server.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("server reports address %v", server.Addr())
+	}
+	dialServer(t, server)
+}
+
+// fileWrittenLine sends a file to a server logging to a buffer and returns the line logging it was written
+func fileWrittenLine(t *testing.T, dir string) string {
+	t.Helper()
+	logs := &logBuffer{}
+	server := startServer(t, Config{StorageDir: dir, Logger: slog.New(slog.NewTextHandler(logs, nil))})
+	dialServer(t, server).sendFiles(testFile{name: "a.txt", content: []byte("logged")})
+	waitForLog(t, logs, `msg="file written"`)
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, `msg="file written"`) {
+			return line
+		}
+	}
+	return ""
+}
+
+func TestLogsStoredPath(t *testing.T) {
+	dir := t.TempDir()
+	line := fileWrittenLine(t, dir)
+	absDir, _ := filepath.Abs(dir)
+	for _, want := range []string{"path=" + filepath.Join(absDir, "a.txt"), "name=a.txt"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("log line %q lacks %q", line, want)
+		}
+	}
+}
+
+func TestLogsRemoteAddress(t *testing.T) {
+	if line := fileWrittenLine(t, t.TempDir()); !strings.Contains(line, "remote=127.0.0.1:") {
+		t.Errorf("log line %q lacks the client's address", line)
+	}
+}
+
+func TestInvalidAddress(t *testing.T) {
+	for _, config := range []Config{
+		{IP: "127.0.0.1", Port: "70000"},
+		{IP: "127.0.0.1", Port: "http"},
+		{IP: "bad host!", Port: "0"},
+	} {
+		config.StorageDir = t.TempDir()
+		config.Logger = quietLogger()
+		if err := NewServerFSMWithConfig(config).Run(); err == nil {
+			t.Errorf("server started with IP %q and port %q", config.IP, config.Port)
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir})
+	client := dialServer(t, server)
+	client.sendFiles(testFile{name: "a.txt", content: []byte("first")}, testFile{name: "b.txt", content: []byte("second!")})
+	entries := manifestEntries(t, filepath.Join(dir, defaultManifestName))
+	if len(entries) != 2 {
+		t.Fatalf("manifest has %d entries, want 2", len(entries))
+	}
+	for i, want := range []ManifestEntry{
+		{Name: "a.txt", Size: 5, Checksum: crc32.ChecksumIEEE([]byte("first"))},
+		{Name: "b.txt", Size: 7, Checksum: crc32.ChecksumIEEE([]byte("second!"))},
+	} {
+		got := entries[i]
+		if got.Name != want.Name || got.Size != want.Size || got.Checksum != want.Checksum {
+			t.Errorf("entry %d = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestManifestProtected(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir, Collision: CollisionOverwrite})
+	client := dialServer(t, server)
+	client.sendCount(2)
+	client.send(testFile{name: "a.txt", content: []byte("a")})
+	result, err := client.send(testFile{name: defaultManifestName, content: []byte("not json\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ack != ackRejected || !strings.Contains(result.reason, "manifest") {
+		t.Fatalf("acknowledgement %d with reason %q, want the manifest refused", result.ack, result.reason)
+	}
+	if entries := manifestEntries(t, filepath.Join(dir, defaultManifestName)); len(entries) != 1 {
+		t.Fatalf("manifest has %d entries, want 1", len(entries))
+	}
+
+	query := dialServer(t, server)
+	query.sendMarker(queryRequest)
+	query.sendCount(1)
+	sendBytes(query.writer, []byte(defaultManifestName))
+	if answer, err := query.reader.ReadByte(); err != nil || answer != queryAbsent {
+		t.Fatalf("query for the manifest answered %d, %v", answer, err)
+	}
+}
+
+func TestCollisionPolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy CollisionPolicy
+		ack    byte
+		stored string
+		copy   string
+	}{
+		{CollisionRename, ackOK, "old", "new"},
+		{CollisionOverwrite, ackOK, "new", ""},
+		{CollisionSkip, ackExists, "old", ""},
+	} {
+		t.Run(test.policy.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			os.WriteFile(filepath.Join(dir, "a.txt"), []byte("old"), 0644)
+			server := startServer(t, Config{StorageDir: dir, Collision: test.policy})
+			client := dialServer(t, server)
+			if acks := client.sendFiles(testFile{name: "a.txt", content: []byte("new")}); acks[0] != test.ack {
+				t.Fatalf("acknowledgement %d, want %d", acks[0], test.ack)
+			}
+			if got := readFile(t, filepath.Join(dir, "a.txt")); string(got) != test.stored {
+				t.Errorf("a.txt holds %q, want %q", got, test.stored)
+			}
+			copy, err := os.ReadFile(filepath.Join(dir, "a (1).txt"))
+			if string(copy) != test.copy || (test.copy == "") != errors.Is(err, os.ErrNotExist) {
+				t.Errorf("a (1).txt holds %q, %v, want %q", copy, err, test.copy)
+			}
+		})
+	}
+}
+
+func TestConcurrentRenames(t *testing.T) {
+	dir := t.TempDir()
+	// Fsync widens the gap between choosing a name and moving the file there
+	server := startServer(t, Config{StorageDir: dir, Collision: CollisionRename, Fsync: true})
+	// keyed partials don't share a lock, so every handler picks a name for "a.txt" at the same time
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		client := dialServer(t, server)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.sendCount(1)
+			result, err := client.send(testFile{name: "a.txt", content: []byte(fmt.Sprint(i)), keyed: true})
+			if err == nil && result.ack != ackOK {
+				err = fmt.Errorf("acknowledgement %d", result.ack)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored := map[string]bool{}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "a") {
+			stored[string(readFile(t, filepath.Join(dir, entry.Name())))] = true
+		}
+	}
+	if len(stored) != 8 {
+		t.Fatalf("%d distinct files stored, want 8", len(stored))
+	}
+}
+
+func TestNoClobber(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("old"), 0644)
+	server := startServer(t, Config{StorageDir: dir, NoClobber: true, Collision: CollisionOverwrite})
+	client := dialServer(t, server)
+	client.sendCount(1)
+	if _, err := client.send(testFile{name: "a.txt", content: []byte("new")}); err == nil {
+		t.Fatal("server acknowledged a file overwriting an existing one")
+	}
+	if got := readFile(t, filepath.Join(dir, "a.txt")); string(got) != "old" {
+		t.Fatalf("a.txt holds %q, want it untouched", got)
+	}
+}
+
+func TestCancelAbandonsTransfer(t *testing.T) {
+	dir := t.TempDir()
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	config := Config{StorageDir: dir, BufferSize: defaultBufferSize, Logger: quietLogger(), Storage: NewFileStorage(dir, 0)}
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := NewHandleClientFSM(ctx, serverSide, config, NewManifestWriter(filepath.Join(dir, defaultManifestName)),
+		&Stats{started: time.Now()}, NewSeenKeys(time.Hour), NewPartialLocks())
+	done := make(chan struct{})
+	go func() {
+		handler.Run()
+		close(done)
+	}()
+	client := &testClient{t: t, con: clientSide, reader: bufio.NewReader(clientSide), writer: bufio.NewWriter(clientSide)}
+	client.handshake()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler kept waiting for the client after the context was cancelled")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir, RateLimit: 100000})
+	client := dialServer(t, server)
+	started := time.Now()
+	if acks := client.sendFiles(testFile{name: "a.bin", content: make([]byte, 50000)}); acks[0] != ackOK {
+		t.Fatalf("acknowledgement %d, want %d", acks[0], ackOK)
+	}
+	if elapsed := time.Since(started); elapsed < 400 * time.Millisecond || elapsed > 5 * time.Second {
+		t.Fatalf("receiving 50000 bytes at 100000 per second took %v", elapsed)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	server := startServer(t, Config{})
+	dialServer(t, server).sendFiles(testFile{name: "a.txt", content: []byte("12345")})
+	client := dialServer(t, server)
+	client.sendMarker(statusRequest)
+	reply, err := receiveBytes(client.reader, 64 * 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status StatusSnapshot
+	if err := json.Unmarshal(reply, &status); err != nil {
+		t.Fatalf("invalid status %q: %v", reply, err)
+	}
+	if status.FilesReceived != 1 || status.BytesReceived != 5 || status.Connections != 2 {
+		t.Fatalf("status %+v, want 1 file of 5 bytes over 2 connections", status)
+	}
+}
+
+func TestNoGoroutineLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	server := NewServerFSMWithConfig(Config{IP: "127.0.0.1", Port: "0", StorageDir: t.TempDir(), Logger: quietLogger()})
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Run()
+	}()
+	for server.Addr() == nil {
+		time.Sleep(5 * time.Millisecond)
+	}
+	dialServer(t, server).sendFiles(testFile{name: "a.txt", content: []byte("a")})
+	server.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running after termination, %d before", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSmallBuffer(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir, BufferSize: 7})
+	content := randomContent(t, 100)
+	client := dialServer(t, server)
+	if acks := client.sendFiles(testFile{name: "a.bin", content: content}); acks[0] != ackOK {
+		t.Fatalf("acknowledgement %d, want %d", acks[0], ackOK)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.bin")); !bytes.Equal(got, content) {
+		t.Fatal("stored file differs from the file sent")
+	}
+}
+
+func TestRenderFileName(t *testing.T) {
+	now := time.Date(2024, 5, 1, 13, 14, 15, 0, time.UTC)
+	remote := &net.TCPAddr{IP: net.ParseIP("::1"), Port: 4000}
+	got := renderFileName("{date}-{remote}-{name}{ext}", "report.tar.gz", remote, now)
+	if want := "20240501-131415---1-report.tar.gz"; got != want {
+		t.Fatalf("renderFileName = %q, want %q", got, want)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "same.txt"), []byte("abc"), 0644)
+	server := startServer(t, Config{StorageDir: dir})
+	client := dialServer(t, server)
+	client.sendMarker(queryRequest)
+	client.sendCount(2)
+	sendBytes(client.writer, []byte("same.txt"))
+	sendBytes(client.writer, []byte("missing.txt"))
+	answer, err := client.reader.ReadByte()
+	if err != nil || answer != queryPresent {
+		t.Fatalf("same.txt answered %d, %v", answer, err)
+	}
+	size, _ := receiveInt64(client.reader)
+	checksum, _ := receiveInt(client.reader)
+	if size != 3 || uint32(checksum) != crc32.ChecksumIEEE([]byte("abc")) {
+		t.Errorf("same.txt answered with %d bytes and checksum %08x", size, checksum)
+	}
+	if answer, err := client.reader.ReadByte(); err != nil || answer != queryAbsent {
+		t.Errorf("missing.txt answered %d, %v", answer, err)
+	}
+}
+
+func TestRejectsPartialNames(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir})
+	client := dialServer(t, server)
+	client.sendCount(2)
+	result, err := client.send(testFile{name: ".victim.txt.part", content: []byte("poison")})
+	if err != nil || result.ack != ackRejected {
+		t.Fatalf("partial name answered %d, %v, want it rejected", result.ack, err)
+	}
+	result, err = client.send(testFile{name: "victim.txt", content: []byte("genuine")})
+	if err != nil || result.offset != 0 || result.ack != ackOK {
+		t.Fatalf("victim.txt resumed from %d with %d, %v", result.offset, result.ack, err)
+	}
+	if got := readFile(t, filepath.Join(dir, "victim.txt")); string(got) != "genuine" {
+		t.Fatalf("victim.txt holds %q", got)
+	}
+}
+
+func TestWriteErrorLeavesNoFile(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full to fail writes with")
+	}
+	dir := t.TempDir()
+	partial := partialPath(filepath.Join(dir, "a.txt"))
+	// every write to the partial fails with ENOSPC
+	if err := os.Symlink("/dev/full", partial); err != nil {
+		t.Fatal(err)
+	}
+	server := startServer(t, Config{StorageDir: dir})
+	client := dialServer(t, server)
+	client.sendCount(1)
+	client.send(testFile{name: "a.txt", content: []byte("content")})
+	if !client.closed(2 * time.Second) {
+		t.Fatal("server kept a client whose file could not be written")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "a.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("a.txt exists after a failed write, %v", err)
+	}
+	// the partial stays hidden for a later resume
+	if _, err := os.Lstat(partial); err != nil {
+		t.Fatalf("partial removed: %v", err)
+	}
+}
+
+func TestTuneConnection(t *testing.T) {
+	listener, err := net.Listen(trans, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial(trans, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	con, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	if err := tuneConnection(con, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := con.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keepAlive, noDelay int
+	raw.Control(func(fd uintptr) {
+		keepAlive, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		noDelay, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	})
+	if keepAlive == 0 || noDelay == 0 {
+		t.Fatalf("SO_KEEPALIVE %d, TCP_NODELAY %d, want both set", keepAlive, noDelay)
+	}
+}
+
+func TestIdleConnectionKeptAlive(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir, KeepAlive: time.Second})
+	client := dialServer(t, server)
+	// long enough for a keep-alive probe to go out on the idle connection
+	time.Sleep(1500 * time.Millisecond)
+	if acks := client.sendFiles(testFile{name: "a.txt", content: []byte("late")}); acks[0] != ackOK {
+		t.Fatalf("acknowledgement %d, want %d", acks[0], ackOK)
+	}
+}
+
+func TestFileCountLimits(t *testing.T) {
+	server := startServer(t, Config{MaxFiles: 2})
+	for _, count := range []int{-5, 3} {
+		client := dialServer(t, server)
+		client.sendCount(count)
+		if !client.closed(2 * time.Second) {
+			t.Errorf("count %d was accepted", count)
+		}
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.json")
+	os.WriteFile(path, []byte(`{"ip": "0.0.0.0", "port": "9000", "storage_dir": "/srv/files", "timeout": "30s",
+		"max_clients": 7, "on_collision": "skip", "dir_mode": "0750", "deny_ext": [".exe"], "no_clobber": true}`), 0644)
+	var config Config
+	if err := loadConfigFile(path, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.IP != "0.0.0.0" || config.Port != "9000" || config.StorageDir != "/srv/files" || config.Timeout != 30 * time.Second ||
+		config.MaxClients != 7 || config.Collision != CollisionSkip || config.DirMode != 0750 ||
+		len(config.DenyExtensions) != 1 || !config.NoClobber {
+		t.Fatalf("loaded %+v", config)
+	}
+
+	os.WriteFile(path, []byte(`{"unknown": 1}`), 0644)
+	if err := loadConfigFile(path, &config); err == nil {
+		t.Error("unknown setting accepted")
+	}
+	if err := loadConfigFile(filepath.Join(t.TempDir(), "missing.json"), &config); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file reported as %v, want it to wrap %v", err, os.ErrNotExist)
+	}
+}
+
+func TestIdleClientDropped(t *testing.T) {
+	server := startServer(t, Config{Timeout: 100 * time.Millisecond})
+	client := dialServer(t, server)
+	client.sendCount(1)
+	if !client.closed(5 * time.Second) {
+		t.Fatal("server kept a stalled client")
+	}
+}
+
+func TestCheckExtension(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		allow []string
+		deny  []string
+		ok    bool
+	}{
+		{"a.txt", []string{".txt"}, nil, true},
+		{"a.exe", nil, []string{".exe"}, false},
+		{"a.EXE", nil, []string{".exe"}, false},
+		{"a.png", []string{".txt"}, nil, false},
+		{"a.txt", []string{".txt"}, []string{".txt"}, false},
+	} {
+		if err := checkExtension(test.name, test.allow, test.deny); (err == nil) != test.ok {
+			t.Errorf("checkExtension(%q, %v, %v) = %v", test.name, test.allow, test.deny, err)
+		}
+	}
+}
+
+func TestRejectionContinuesBatch(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir, DenyExtensions: []string{".exe"}, MaxFileSize: 10})
+	client := dialServer(t, server)
+	client.sendCount(3)
+	for _, file := range []testFile{
+		{name: "a.exe", content: []byte("x")},
+		{name: "big.txt", content: bytes.Repeat([]byte("y"), 11)},
+	} {
+		result, err := client.send(file)
+		if err != nil || result.offset != fileRejected || result.ack != ackRejected || result.reason == "" {
+			t.Fatalf("%s answered %+v, %v, want it rejected with a reason", file.name, result, err)
+		}
+	}
+	if result, err := client.send(testFile{name: "b.txt", content: []byte("allowed")}); err != nil || result.ack != ackOK {
+		t.Fatalf("b.txt after the rejections answered %d, %v", result.ack, err)
+	}
+	if got := readFile(t, filepath.Join(dir, "b.txt")); string(got) != "allowed" {
+		t.Fatalf("b.txt holds %q", got)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	if err := selfTest(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClosedConnectionLogged(t *testing.T) {
+	logs := &logBuffer{}
+	server := startServer(t, Config{Logger: slog.New(slog.NewTextHandler(logs, nil))})
+	client := dialServer(t, server)
+	client.con.Close()
+	waitForLog(t, logs, "client closed connection")
+}
+
+func TestMemoryStorage(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewMemoryStorage()
+	server := startServer(t, Config{StorageDir: dir, Storage: storage})
+	content := randomContent(t, 100 * 1024)
+	client := dialServer(t, server)
+	client.sendFiles(testFile{name: "sub/a.bin", content: content}, testFile{name: "bad.bin", content: content, corrupt: true})
+	got, ok := storage.File("sub/a.bin")
+	if !ok || !bytes.Equal(got, content) {
+		t.Fatal("memory storage doesn't hold the file sent")
+	}
+	if _, ok := storage.File("bad.bin"); ok {
+		t.Error("file with a checksum mismatch kept")
+	}
+	// nothing but the manifest touches the disk
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if entry.Name() != defaultManifestName {
+			t.Errorf("%s written to the storage directory", entry.Name())
+		}
+	}
+}
+
+func TestFileStorageCreate(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewFileStorage(dir, 0)
+	file, err := storage.Create("sub/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(file, "content")
+	if _, err := os.Stat(filepath.Join(dir, "sub", "a.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("file visible under its name before it is closed")
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dir, "sub", "a.txt")); string(got) != "content" {
+		t.Fatalf("stored %q", got)
+	}
+
+	file, _ = storage.Create("b.txt")
+	io.WriteString(file, "discarded")
+	abortFile(file)
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("aborted file left %d entries behind", len(entries) - 1)
+	}
+	if _, err := storage.Create("../escape.txt"); err == nil {
+		t.Error("name leaving the directory accepted")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	server := startServer(t, Config{})
+	dialServer(t, server)
+
+	badMagic := connect(t, server)
+	badMagic.writer.WriteString("HTTP/")
+	badMagic.writer.Flush()
+	if !badMagic.closed(2 * time.Second) {
+		t.Error("connection with a bad magic kept open")
+	}
+
+	if reply := connect(t, server).sendHandshake(protocolMagic, protocolVersion + 1); reply != handshakeUnsupported {
+		t.Errorf("unsupported version answered %d, want %d", reply, handshakeUnsupported)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	logs := &logBuffer{}
+	server := startServer(t, Config{MetricsAddr: "127.0.0.1:0", Logger: slog.New(slog.NewTextHandler(logs, nil))})
+	waitForLog(t, logs, "serving metrics")
+	_, rest, _ := strings.Cut(logs.String(), `"serving metrics" addr=`)
+	addr := strings.Fields(rest)[0]
+	client := dialServer(t, server)
+	if acks := client.sendFiles(testFile{name: "a.txt", content: []byte("abc")}); acks[0] != ackOK {
+		t.Fatalf("acknowledgement %d, want %d", acks[0], ackOK)
+	}
+	response, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	for _, line := range []string{
+		"# TYPE filetransfer_files_received_total counter",
+		"filetransfer_files_received_total 1\n",
+		"filetransfer_bytes_received_total 3\n",
+		"filetransfer_connections_total 1\n",
+		"filetransfer_errors_total 0\n",
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("metrics lack %q:\n%s", line, body)
+		}
+	}
+}
+
+func TestUnchangedFileNotRewritten(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir})
+	file := testFile{name: "a.txt", content: []byte("same content")}
+	dialServer(t, server).sendFiles(file)
+	before, err := os.Stat(filepath.Join(dir, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialServer(t, server).sendFiles(file)
+	after, err := os.Stat(filepath.Join(dir, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("identical file written again")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a (1).txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("identical file stored as a copy")
+	}
+}
+
+func TestUnchangedFileNotWrittenToPartial(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full to fail writes with")
+	}
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir})
+	file := testFile{name: "a.txt", content: randomContent(t, 64 * 1024)}
+	dialServer(t, server).sendFiles(file)
+	// any write to the partial now fails, so only a file compared as it arrives can be acknowledged
+	if err := os.Symlink("/dev/full", partialPath(filepath.Join(dir, "a.txt"))); err != nil {
+		t.Fatal(err)
+	}
+	if acks := dialServer(t, server).sendFiles(file); acks[0] != ackOK {
+		t.Fatalf("acknowledgement %d, want %d", acks[0], ackOK)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.txt")); !bytes.Equal(got, file.content) {
+		t.Fatal("stored file changed")
+	}
+}
+
+func TestChangedFileOfSameSize(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir, Collision: CollisionOverwrite, BufferSize: 1024})
+	content := randomContent(t, 10 * 1024)
+	dialServer(t, server).sendFiles(testFile{name: "a.txt", content: content})
+	// the first differing byte is well into the file, so the matching part has to be copied over
+	changed := bytes.Clone(content)
+	changed[5000] ^= 0xff
+	if acks := dialServer(t, server).sendFiles(testFile{name: "a.txt", content: changed}); acks[0] != ackOK {
+		t.Fatalf("acknowledgement %d, want %d", acks[0], ackOK)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.txt")); !bytes.Equal(got, changed) {
+		t.Fatal("stored file differs from the file sent")
+	}
+}
+
+func TestManyConnections(t *testing.T) {
+	server := startServer(t, Config{MaxClients: 50})
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			con, err := net.DialTimeout(trans, server.Addr().String(), 5 * time.Second)
+			if err != nil {
+				t.Errorf("connection %d refused: %v", i, err)
+				return
+			}
+			con.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMinRate(t *testing.T) {
+	server := startServer(t, Config{MinRate: 100 * 1024})
+	client := dialServer(t, server)
+	client.sendCount(1)
+	// the rate allows about 10ms for the file, which the half sent then stalls far beyond
+	_, err := client.send(testFile{name: "slow.bin", content: make([]byte, 1024), stopAfter: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !client.closed(5 * time.Second) {
+		t.Fatal("server kept a client sending below the minimum rate")
+	}
+}
+
+func TestInconsistentSize(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir})
+	client := dialServer(t, server)
+	client.sendCount(1)
+	file := testFile{name: "short.txt", content: []byte("announced size")}
+	// the stream carries fewer bytes than the header announced
+	sendInt(client.writer, filePresent)
+	sendBytes(client.writer, []byte(file.name))
+	sendInt(client.writer, 0644)
+	sendInt64(client.writer, time.Now().UnixNano())
+	sendInt64(client.writer, 100)
+	sendInt(client.writer, -1)
+	sendInt(client.writer, -1)
+	client.writer.WriteByte(0)
+	sendBytes(client.writer, nil)
+	if offset, err := receiveInt64(client.reader); err != nil || offset != 0 {
+		t.Fatalf("offset %d, %v", offset, err)
+	}
+	client.writer.WriteByte(0)
+	sendInt64(client.writer, int64(len(file.content)))
+	client.writer.Write(file.content)
+	client.writer.Flush()
+	if !client.closed(2 * time.Second) {
+		t.Fatal("server kept a client whose content doesn't match its header")
+	}
+	if _, err := os.Stat(filepath.Join(dir, file.name)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("file stored although its content was short")
+	}
+}
+
+func TestContentBeyondAnnouncedSize(t *testing.T) {
+	for _, file := range []testFile{
+		{name: "bomb.txt", content: make([]byte, 1 << 20), flags: contentCompressed, size: 1000},
+		{name: "hole.img", content: make([]byte, 1 << 20), flags: contentSparse, chunkSize: 1 << 20, size: 1000},
+	} {
+		t.Run(file.name, func(t *testing.T) {
+			dir := t.TempDir()
+			server := startServer(t, Config{StorageDir: dir})
+			client := dialServer(t, server)
+			client.sendCount(1)
+			client.send(file)
+			if !client.closed(2 * time.Second) {
+				t.Fatal("server kept a client whose content outgrew its header")
+			}
+			if _, err := os.Stat(filepath.Join(dir, file.name)); !errors.Is(err, os.ErrNotExist) {
+				t.Fatal("file stored although its content outgrew its header")
+			}
+			// no more than the announced size ever reached the disk
+			if info, err := os.Stat(partialPath(filepath.Join(dir, file.name))); err == nil && info.Size() > file.size {
+				t.Fatalf("partial holds %d bytes, more than the %d announced", info.Size(), file.size)
+			}
+		})
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "server.sock")
+	server := startServer(t, Config{IP: unixPrefix + socket, StorageDir: filepath.Join(dir, "stored")})
+	dialServer(t, server).sendFiles(testFile{name: "a.txt", content: []byte("over a socket")})
+	if got := readFile(t, filepath.Join(dir, "stored", "a.txt")); string(got) != "over a socket" {
+		t.Fatalf("stored %q", got)
+	}
+}
+
+func TestDirMode(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "stored")
+	server := startServer(t, Config{StorageDir: dir, DirMode: 0750})
+	dialServer(t, server).sendFiles(testFile{name: "sub/a.txt", content: []byte("a")})
+	info, err := os.Stat(dir)
+	if err != nil || info.Mode().Perm() != 0750 {
+		t.Fatalf("storage directory mode %v, %v, want %v", info.Mode().Perm(), err, os.FileMode(0750))
+	}
+}
+
+func TestMaxConnectionBytes(t *testing.T) {
+	server := startServer(t, Config{MaxConnectionBytes: 100})
+	client := dialServer(t, server)
+	client.sendCount(2)
+	if result, err := client.send(testFile{name: "a.bin", content: make([]byte, 60)}); err != nil || result.ack != ackOK {
+		t.Fatalf("first file answered %d, %v", result.ack, err)
+	}
+	if _, err := client.send(testFile{name: "b.bin", content: make([]byte, 60)}); err == nil {
+		t.Fatal("server took a file past the connection's limit")
+	}
+}
+
+func TestFsync(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir, Fsync: true})
+	dialServer(t, server).sendFiles(testFile{name: "a.txt", content: []byte("durable")})
+	if got := readFile(t, filepath.Join(dir, "a.txt")); string(got) != "durable" {
+		t.Fatalf("stored %q", got)
+	}
+}
+
+func TestChunkAcks(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir})
+	content := randomContent(t, 1000)
+	client := dialServer(t, server)
+	client.sendCount(1)
+	result, err := client.send(testFile{name: "a.bin", content: content, flags: contentChunkAck, chunkSize: 100})
+	if err != nil || result.ack != ackOK {
+		t.Fatalf("acknowledgement %d, %v", result.ack, err)
+	}
+	if result.chunkAcks != 10 {
+		t.Errorf("%d chunks acknowledged, want 10", result.chunkAcks)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.bin")); !bytes.Equal(got, content) {
+		t.Fatal("stored file differs from the file sent")
+	}
+}
+
+func TestCheckSpace(t *testing.T) {
+	dir := t.TempDir()
+	handler := &HandleClientFSM{fileName: "huge.bin", fileSize: 1 << 62, partial: filepath.Join(dir, ".huge.bin.part")}
+	err := handler.checkSpace()
+	if err == nil || !strings.Contains(err.Error(), "not enough free space") {
+		t.Fatalf("checkSpace = %v, want it to refuse the file", err)
+	}
+	handler.fileSize = 1
+	if err := handler.checkSpace(); err != nil {
+		t.Fatalf("checkSpace refused a 1 byte file: %v", err)
+	}
+}
+
+func TestIncrementalChecksum(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir, BufferSize: 4096})
+	whole := randomContent(t, 3 << 20)
+	resumed := randomContent(t, 100 * 1024)
+	// only the tail of a resumed file goes through the running checksum, the rest is read back from the partial
+	os.WriteFile(partialPath(filepath.Join(dir, "resumed.bin")), resumed[:30000], 0600)
+	client := dialServer(t, server)
+	client.sendFiles(testFile{name: "whole.bin", content: whole}, testFile{name: "resumed.bin", content: resumed})
+	entries := manifestEntries(t, filepath.Join(dir, defaultManifestName))
+	if len(entries) != 2 {
+		t.Fatalf("manifest has %d entries, want 2", len(entries))
+	}
+	for i, content := range [][]byte{whole, resumed} {
+		if want := crc32.ChecksumIEEE(content); entries[i].Checksum != want {
+			t.Errorf("%s recorded with checksum %08x, the whole file's is %08x", entries[i].Name, entries[i].Checksum, want)
+		}
+	}
+}
+
+func TestSparseHoles(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir})
+	const chunk = 64 * 1024
+	content := make([]byte, 32 * chunk)
+	copy(content, "start")
+	copy(content[len(content) - chunk:], "end")
+	client := dialServer(t, server)
+	client.sendFiles(testFile{name: "disk.img", content: content, flags: contentSparse, chunkSize: chunk})
+	path := filepath.Join(dir, "disk.img")
+	if got := readFile(t, path); !bytes.Equal(got, content) {
+		t.Fatal("stored file differs from the file sent")
+	}
+	info, _ := os.Stat(path)
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Blocks * 512 >= int64(len(content)) {
+		t.Errorf("%d bytes allocated for a %d byte file that is mostly holes", stat.Blocks * 512, len(content))
+	}
+}
+
+func TestDestination(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir})
+	client := connect(t, server)
+	client.handshake()
+	if reply := client.destination("backups/today"); reply != destinationOK {
+		t.Fatalf("destination refused with %d", reply)
+	}
+	client.sendFiles(testFile{name: "a.txt", content: []byte("placed")})
+	if got := readFile(t, filepath.Join(dir, "backups", "today", "a.txt")); string(got) != "placed" {
+		t.Fatalf("stored %q", got)
+	}
+
+	escape := connect(t, server)
+	escape.handshake()
+	if reply := escape.destination("../outside"); reply != destinationRefused {
+		t.Fatalf("destination leaving the storage directory answered %d", reply)
+	}
+}
+
+func TestScanCommand(t *testing.T) {
+	dir := t.TempDir()
+	quarantine := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir, QuarantineDir: quarantine, ScanCommand: `grep -q clean "$FILE_PATH"`})
+	client := dialServer(t, server)
+	acks := client.sendFiles(testFile{name: "ok.txt", content: []byte("clean")}, testFile{name: "bad.txt", content: []byte("virus")})
+	if acks[0] != ackOK || acks[1] != ackRejected {
+		t.Fatalf("acknowledgements %v, want %d and %d", acks, ackOK, ackRejected)
+	}
+	if got := readFile(t, filepath.Join(dir, "ok.txt")); string(got) != "clean" {
+		t.Errorf("ok.txt holds %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("file failing the scan stored")
+	}
+	if entries, _ := os.ReadDir(quarantine); len(entries) != 0 {
+		t.Errorf("%d files left in quarantine", len(entries))
+	}
+}
+
+func TestFileCompleteWhenAcknowledged(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir})
+	client := dialServer(t, server)
+	client.sendCount(3)
+	for i := 0; i < 3; i++ {
+		file := testFile{name: fmt.Sprintf("%d.bin", i), content: randomContent(t, 100 * 1024)}
+		result, err := client.send(file)
+		if err != nil || result.ack != ackOK {
+			t.Fatalf("%s acknowledged with %d, %v", file.name, result.ack, err)
+		}
+		// the acknowledgement only goes out once the file is complete on disk
+		if got := readFile(t, filepath.Join(dir, file.name)); !bytes.Equal(got, file.content) {
+			t.Fatalf("%s holds %d bytes when acknowledged, want %d", file.name, len(got), len(file.content))
+		}
+	}
+	// the last acknowledgement arrived before the server closed the connection
+	if !client.closed(2 * time.Second) {
+		t.Fatal("server kept the connection after the announced files")
+	}
+}
+
+func TestExecStorage(t *testing.T) {
+	dir := t.TempDir()
+	out := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir, Exec: fmt.Sprintf(`cat > '%s'/"$FILE_NAME"`, out)})
+	content := randomContent(t, 200 * 1024)
+	dialServer(t, server).sendFiles(testFile{name: "piped.bin", content: content})
+	if got := readFile(t, filepath.Join(out, "piped.bin")); !bytes.Equal(got, content) {
+		t.Fatal("command received different content")
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".piped.bin.part")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("content written to a partial file before the command")
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	dir := t.TempDir()
+	server := startServer(t, Config{StorageDir: dir, Collision: CollisionOverwrite})
+	dialServer(t, server).sendFiles(testFile{name: "a.txt", content: []byte("first"), key: "run-1"})
+	client := dialServer(t, server)
+	client.sendCount(1)
+	result, err := client.send(testFile{name: "a.txt", content: []byte("second"), key: "run-1"})
+	if err != nil || result.offset != alreadyStored || result.ack != ackOK {
+		t.Fatalf("resend answered %+v, %v, want it acknowledged as already stored", result, err)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.txt")); string(got) != "first" {
+		t.Errorf("a.txt holds %q, want the first write only", got)
+	}
+	if entries := manifestEntries(t, filepath.Join(dir, defaultManifestName)); len(entries) != 1 {
+		t.Errorf("manifest has %d entries, want 1", len(entries))
+	}
+}
+
+func TestSeenKeysExpire(t *testing.T) {
+	keys := NewSeenKeys(50 * time.Millisecond)
+	keys.Add("old")
+	if !keys.Seen("old") {
+		t.Fatal("key forgotten right after it was added")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if keys.Seen("old") {
+		t.Fatal("expired key still seen")
+	}
+	keys.Add("stale")
+	time.Sleep(60 * time.Millisecond)
+	// a ttl has passed since the last sweep, so adding drops the key nobody asked about
+	keys.Add("new")
+	keys.mu.Lock()
+	defer keys.mu.Unlock()
+	if _, ok := keys.keys["stale"]; ok || len(keys.keys) != 1 {
+		t.Fatalf("%d keys kept after a sweep, want only the new one", len(keys.keys))
+	}
+}
+
+func TestKeyedResumeAfterRename(t *testing.T) {
+	dir := t.TempDir()
+	content := randomContent(t, 4096)
+	os.WriteFile(keyedPartialPath(dir, crc32.ChecksumIEEE(content), int64(len(content))), content[:1000], 0600)
+	server := startServer(t, Config{StorageDir: dir})
+	client := dialServer(t, server)
+	client.sendCount(1)
+	result, err := client.send(testFile{name: "renamed.bin", content: content, keyed: true})
+	if err != nil || result.offset != 1000 || result.ack != ackOK {
+		t.Fatalf("resumed from %d with %d, %v, want 1000", result.offset, result.ack, err)
+	}
+	if got := readFile(t, filepath.Join(dir, "renamed.bin")); !bytes.Equal(got, content) {
+		t.Fatal("stored file differs from the file sent")
+	}
+}
+
+func TestMaxSession(t *testing.T) {
+	server := startServer(t, Config{MaxSession: 200 * time.Millisecond})
+	client := dialServer(t, server)
+	client.sendCount(3)
+	for i := 0; i < 3; i++ {
+		if _, err := client.send(testFile{name: fmt.Sprintf("%d.txt", i), content: []byte("a")}); err != nil {
+			return
+		}
+		time.Sleep(150 * time.Millisecond)
+	}
+	t.Fatal("client stayed connected past the session limit")
+}
+
+func TestClientAllowed(t *testing.T) {
+	allowed, err := parseClientPrefixes([]string{"127.0.0.1", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		addr string
+		ok   bool
+	}{
+		{"127.0.0.1:5000", true},
+		{"[::ffff:127.0.0.1]:5000", true},
+		{"10.1.2.3:5000", true},
+		{"127.0.0.2:5000", false},
+		{"[::1]:5000", false},
+	} {
+		addr, _ := net.ResolveTCPAddr(trans, test.addr)
+		if got := clientAllowed(addr, allowed); got != test.ok {
+			t.Errorf("clientAllowed(%s) = %v, want %v", test.addr, got, test.ok)
+		}
+	}
+}